@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// asciicastHeader is the first line of an asciicast v2 recording.
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// asciicastWriter records a terminal session in asciicast v2 format. Write
+// never fails so that a broken recording does not end the session.
+type asciicastWriter struct {
+	mu      sync.Mutex
+	f       *os.File
+	start   time.Time
+	width   int
+	height  int
+	pending []byte
+	failed  bool
+}
+
+func newAsciicastWriter(fileName string, header asciicastHeader) (*asciicastWriter, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	header.Version = 2
+	header.Timestamp = time.Now().Unix()
+	w := &asciicastWriter{
+		f:      f,
+		start:  time.Now(),
+		width:  header.Width,
+		height: header.Height,
+	}
+	if err := w.writeLine(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *asciicastWriter) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.Write(append(line, '\n'))
+	return err
+}
+
+func (w *asciicastWriter) event(code, data string) {
+	if w.failed {
+		return
+	}
+	elapsed := time.Since(w.start).Seconds()
+	if err := w.writeLine([]interface{}{elapsed, code, data}); err != nil {
+		log.Printf("recording %s stopped: %s", w.f.Name(), err)
+		w.failed = true
+	}
+}
+
+// Write records terminal output. Incomplete UTF-8 sequences at the end of
+// p are held back until the rest arrives.
+func (w *asciicastWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data := append(w.pending, p...)
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	w.pending = append([]byte(nil), data[end:]...)
+	if end > 0 {
+		w.event("o", string(data[:end]))
+	}
+	return len(p), nil
+}
+
+// Resize records a change of the terminal size.
+func (w *asciicastWriter) Resize(width, height int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if width == w.width && height == w.height {
+		return
+	}
+	w.width, w.height = width, height
+	w.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (w *asciicastWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) > 0 {
+		w.event("o", string(w.pending))
+		w.pending = nil
+	}
+	return w.f.Close()
+}
+
+// replayMain plays an asciicast recording back in the terminal.
+func replayMain() {
+	newFlag := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	var speed float64
+	var idleLimit float64
+	newFlag.Float64Var(&speed, "speed", 1, "Playback speed")
+	newFlag.Float64Var(&idleLimit, "idle-limit", 2, "Maximum pause between events in seconds, 0 for no limit")
+	err := newFlag.Parse(os.Args[2:])
+	if err != nil {
+		panic(err)
+	}
+	if newFlag.NArg() != 1 || speed <= 0 {
+		log.Fatal("Usage: ppobox replay [-speed 1] [-idle-limit 2] recording.cast")
+	}
+
+	f, err := os.Open(newFlag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	if !scanner.Scan() {
+		log.Fatal("empty recording")
+	}
+	var header asciicastHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		log.Fatal(err)
+	}
+	if header.Version != 2 {
+		log.Fatalf("unsupported asciicast version %d", header.Version)
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			continue
+		}
+		at, _ := event[0].(float64)
+		code, _ := event[1].(string)
+		data, _ := event[2].(string)
+
+		delay := at - last
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		last = at
+		time.Sleep(time.Duration(delay / speed * float64(time.Second)))
+
+		if code == "o" {
+			os.Stdout.WriteString(data)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
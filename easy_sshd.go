@@ -2,8 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -16,24 +19,8 @@ func toLinuxPath(path string) string {
 	return strings.Replace(path, "\\", "/", -1)
 }
 
-func sftpPush() {
-
-	newFlag := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
-	var username, password, host, port, localPath, remotePath string
-
-	newFlag.StringVar(&username, "username", "", "Username")
-	newFlag.StringVar(&password, "password", "", "Password")
-	newFlag.StringVar(&host, "host", "127.0.0.1", "Host")
-	newFlag.StringVar(&port, "port", "2222", "Port")
-	newFlag.StringVar(&localPath, "local", "", "Local path")
-	newFlag.StringVar(&remotePath, "remote", "", "Remote path")
-
-	err := newFlag.Parse(os.Args[2:])
-
-	if err != nil {
-		panic(err)
-	}
-
+// sftpDial logs in to the SFTP server of gosftp-push and gosftp-pull.
+func sftpDial(username, password, host, port string) *sftp.Client {
 	conn, err := ssh.Dial("tcp", host+":"+port, &ssh.ClientConfig{
 		User: username,
 		Auth: []ssh.AuthMethod{
@@ -51,9 +38,38 @@ func sftpPush() {
 	if err != nil {
 		panic(err)
 	}
+	return client
+}
 
+func sftpPush() {
+
+	newFlag := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	var username, password, host, port, localPath, remotePath string
+
+	newFlag.StringVar(&username, "username", "", "Username")
+	newFlag.StringVar(&password, "password", "", "Password")
+	newFlag.StringVar(&host, "host", "127.0.0.1", "Host")
+	newFlag.StringVar(&port, "port", "2222", "Port")
+	var include, exclude listFlag
+	newFlag.StringVar(&localPath, "local", "", "Local path, a file or a directory to push recursively")
+	newFlag.StringVar(&remotePath, "remote", "", "Remote path")
+	newFlag.Var(&include, "include", "Comma separated glob patterns of the files to push from a directory, all if empty")
+	newFlag.Var(&exclude, "exclude", "Comma separated glob patterns of the files and directories not to push from a directory")
+
+	err := newFlag.Parse(os.Args[2:])
+
+	if err != nil {
+		panic(err)
+	}
+
+	client := sftpDial(username, password, host, port)
 	defer client.Close()
 
+	if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+		sftpPushDir(client, localPath, toLinuxPath(remotePath), include, exclude)
+		return
+	}
+
 	f, err := os.Open(localPath)
 	if err != nil {
 		panic(err)
@@ -105,3 +121,262 @@ func sftpPush() {
 	}
 
 }
+
+// sftpPushDir mirrors the directory tree localDir to remoteDir, creating
+// the remote directories as needed. Patterns without a slash match the
+// name of a file or directory, the others its path relative to localDir.
+// Excluding a directory skips everything below it.
+func sftpPushDir(client *sftp.Client, localDir, remoteDir string, include, exclude []string) {
+	var dirs, files []string
+	var total int64
+	skipped := 0
+	err := filepath.WalkDir(localDir, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, fileName)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if matchPathPatterns(exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			skipped++
+			return nil
+		}
+		if d.IsDir() {
+			// with -include only the directories of pushed files are created
+			if len(include) == 0 {
+				dirs = append(dirs, rel)
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || (len(include) > 0 && !matchPathPatterns(include, rel)) {
+			skipped++
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		total += fi.Size()
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if err := client.MkdirAll(remoteDir); err != nil {
+		panic(err)
+	}
+	for _, dir := range dirs {
+		if err := client.MkdirAll(path.Join(remoteDir, dir)); err != nil {
+			panic(err)
+		}
+	}
+
+	bar := progressbar.DefaultBytes(total, "uploading")
+	for _, rel := range files {
+		f, err := os.Open(filepath.Join(localDir, filepath.FromSlash(rel)))
+		if err != nil {
+			panic(err)
+		}
+		if err := client.MkdirAll(path.Join(remoteDir, path.Dir(rel))); err != nil {
+			panic(err)
+		}
+		remoteFile, err := client.Create(path.Join(remoteDir, rel))
+		if err != nil {
+			panic(err)
+		}
+		_, err = io.Copy(remoteFile, &readerFile{File: f, bar: bar})
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		if err := remoteFile.Close(); err != nil {
+			panic(err)
+		}
+	}
+	bar.Finish()
+	fmt.Printf("\n%d files sent (%s), %d skipped\n", len(files), formatBytes(total), skipped)
+}
+
+// matchPathPatterns reports whether one of the glob patterns of -include
+// or -exclude matches the slash separated relative path rel.
+func matchPathPatterns(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func sftpPull() {
+
+	newFlag := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	var username, password, host, port, localPath, remotePath string
+
+	newFlag.StringVar(&username, "username", "", "Username")
+	newFlag.StringVar(&password, "password", "", "Password")
+	newFlag.StringVar(&host, "host", "127.0.0.1", "Host")
+	newFlag.StringVar(&port, "port", "2222", "Port")
+	var include, exclude listFlag
+	newFlag.StringVar(&localPath, "local", "", "Local path, into which a file is pulled when it is a directory, the remote file's name if empty")
+	newFlag.StringVar(&remotePath, "remote", "", "Remote path, a file or a directory to pull recursively")
+	newFlag.Var(&include, "include", "Comma separated glob patterns of the files to pull from a directory, all if empty")
+	newFlag.Var(&exclude, "exclude", "Comma separated glob patterns of the files and directories not to pull from a directory")
+
+	err := newFlag.Parse(os.Args[2:])
+
+	if err != nil {
+		panic(err)
+	}
+
+	client := sftpDial(username, password, host, port)
+	defer client.Close()
+
+	remotePath = toLinuxPath(remotePath)
+	fileInfo, err := client.Stat(remotePath)
+	if err != nil {
+		panic(err)
+	}
+	if fileInfo.IsDir() {
+		sftpPullDir(client, remotePath, localPath, include, exclude)
+		return
+	}
+
+	if localPath == "" {
+		localPath = path.Base(remotePath)
+	} else if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+	bar := progressbar.DefaultBytes(fileInfo.Size(), "downloading")
+	sftpPullFile(client, remotePath, localPath, fileInfo, bar)
+}
+
+// sftpPullDir mirrors the remote directory tree remoteDir to localDir,
+// filtering like sftpPushDir.
+func sftpPullDir(client *sftp.Client, remoteDir, localDir string, include, exclude []string) {
+	type entry struct {
+		rel  string
+		info os.FileInfo
+	}
+	var dirs, files []entry
+	var total int64
+	skipped := 0
+	walker := client.Walk(remoteDir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			panic(err)
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remoteDir), "/")
+		if rel == "" {
+			continue
+		}
+		// the names come from the server, which must not get to write
+		// outside localDir
+		if clean := path.Clean(rel); path.IsAbs(rel) || clean == ".." || strings.HasPrefix(clean, "../") || !filepath.IsLocal(filepath.FromSlash(rel)) {
+			panic(fmt.Errorf("refusing remote path %q outside %s", walker.Path(), remoteDir))
+		}
+		fi := walker.Stat()
+		if matchPathPatterns(exclude, rel) {
+			if fi.IsDir() {
+				walker.SkipDir()
+			} else {
+				skipped++
+			}
+			continue
+		}
+		if fi.IsDir() {
+			if len(include) == 0 {
+				dirs = append(dirs, entry{rel, fi})
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() || (len(include) > 0 && !matchPathPatterns(include, rel)) {
+			skipped++
+			continue
+		}
+		files = append(files, entry{rel, fi})
+		total += fi.Size()
+	}
+
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		panic(err)
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(localDir, filepath.FromSlash(dir.rel)), 0755); err != nil {
+			panic(err)
+		}
+	}
+
+	bar := progressbar.DefaultBytes(total, "downloading")
+	for _, file := range files {
+		localFile := filepath.Join(localDir, filepath.FromSlash(file.rel))
+		sftpPullFile(client, path.Join(remoteDir, file.rel), localFile, file.info, bar)
+	}
+	// writing the files changed the modification times of the directories
+	for i := len(dirs) - 1; i >= 0; i-- {
+		setFileModeTime(filepath.Join(localDir, filepath.FromSlash(dirs[i].rel)), dirs[i].info)
+	}
+	bar.Finish()
+	fmt.Printf("\n%d files received (%s), %d skipped\n", len(files), formatBytes(total), skipped)
+}
+
+// sftpPullFile downloads remoteFile to localFile, keeping its mode and
+// modification time.
+func sftpPullFile(client *sftp.Client, remoteFile, localFile string, fileInfo os.FileInfo, bar *progressbar.ProgressBar) {
+	if err := os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
+		panic(err)
+	}
+	src, err := client.Open(remoteFile)
+	if err != nil {
+		panic(err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(localFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.Copy(io.MultiWriter(dst, bar), src)
+	if err != nil {
+		panic(err)
+	}
+	if err := dst.Close(); err != nil {
+		panic(err)
+	}
+	setFileModeTime(localFile, fileInfo)
+}
+
+func setFileModeTime(fileName string, fileInfo os.FileInfo) {
+	if err := os.Chmod(fileName, fileInfo.Mode().Perm()); err != nil {
+		panic(err)
+	}
+	if err := os.Chtimes(fileName, fileInfo.ModTime(), fileInfo.ModTime()); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sshdAdmin keeps track of the connections and sessions of easy-sshd for
+// the admin API served on -admin-listen:
+//
+//	GET    /connections      the open connections and their sessions
+//	GET    /sessions         the running sessions
+//	DELETE /connections/{id} closes a connection
+//	DELETE /sessions/{id}    ends a session, hanging up its processes
+//
+// On a host:port, requests must carry the token of -admin-token-file as
+// "Authorization: Bearer <token>". A nil *sshdAdmin tracks nothing.
+type sshdAdmin struct {
+	nextID atomic.Int64
+
+	mu       sync.Mutex
+	conns    map[int64]*adminConn
+	sessions map[int64]*adminSession
+}
+
+var contextKeyAdminConn = &sshdContextKey{"admin-conn"}
+
+func newSSHDAdmin() *sshdAdmin {
+	return &sshdAdmin{
+		conns:    make(map[int64]*adminConn),
+		sessions: make(map[int64]*adminSession),
+	}
+}
+
+// adminConn is a connection that counts the bytes passing through it.
+type adminConn struct {
+	net.Conn
+	id      int64
+	ctx     ssh.Context
+	start   time.Time
+	read    atomic.Int64
+	written atomic.Int64
+
+	once    sync.Once
+	release func()
+
+	mu      sync.Mutex
+	methods []string
+}
+
+func (c *adminConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *adminConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *adminConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// adminSession is a session that counts the bytes of its stdin and stdout
+// and can be ended on its own. Its context is done when the session is
+// terminated, so that its processes are hung up like on a disconnect.
+type adminSession struct {
+	ssh.Session
+	id      int64
+	conn    *adminConn
+	ctx     *adminSessionContext
+	start   time.Time
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+type adminSessionContext struct {
+	ssh.Context
+	done   context.Context
+	cancel context.CancelFunc
+}
+
+func (c *adminSessionContext) Done() <-chan struct{} { return c.done.Done() }
+func (c *adminSessionContext) Err() error            { return c.done.Err() }
+
+func (s *adminSession) Context() ssh.Context { return s.ctx }
+
+func (s *adminSession) Read(p []byte) (int, error) {
+	n, err := s.Session.Read(p)
+	s.read.Add(int64(n))
+	return n, err
+}
+
+func (s *adminSession) Write(p []byte) (int, error) {
+	n, err := s.Session.Write(p)
+	s.written.Add(int64(n))
+	return n, err
+}
+
+// terminate ends the session.
+func (s *adminSession) terminate() {
+	s.ctx.cancel()
+	s.Session.Close()
+}
+
+// connCallback registers conn.
+func (a *sshdAdmin) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	if a == nil {
+		return conn
+	}
+	c := &adminConn{
+		Conn:  conn,
+		id:    a.nextID.Add(1),
+		ctx:   ctx,
+		start: time.Now(),
+	}
+	c.release = func() {
+		a.mu.Lock()
+		delete(a.conns, c.id)
+		a.mu.Unlock()
+	}
+	a.mu.Lock()
+	a.conns[c.id] = c
+	a.mu.Unlock()
+	ctx.SetValue(contextKeyAdminConn, c)
+	return c
+}
+
+// authLog records the authentication methods a connection succeeded with.
+func (a *sshdAdmin) authLog(ctx ssh.Context, method string, err error) {
+	if a == nil {
+		return
+	}
+	var partial *gossh.PartialSuccessError
+	if err != nil && !errors.As(err, &partial) {
+		return
+	}
+	if c, ok := ctx.Value(contextKeyAdminConn).(*adminConn); ok {
+		c.mu.Lock()
+		c.methods = append(c.methods, method)
+		c.mu.Unlock()
+	}
+}
+
+// track wraps a session or subsystem handler so that its sessions are
+// listed and can be terminated.
+func (a *sshdAdmin) track(next func(ssh.Session)) func(ssh.Session) {
+	if a == nil {
+		return next
+	}
+	return func(s ssh.Session) {
+		done, cancel := context.WithCancel(s.Context())
+		defer cancel()
+		as := &adminSession{
+			Session: s,
+			id:      a.nextID.Add(1),
+			ctx:     &adminSessionContext{Context: s.Context(), done: done, cancel: cancel},
+			start:   time.Now(),
+		}
+		as.conn, _ = s.Context().Value(contextKeyAdminConn).(*adminConn)
+
+		a.mu.Lock()
+		a.sessions[as.id] = as
+		a.mu.Unlock()
+		defer func() {
+			a.mu.Lock()
+			delete(a.sessions, as.id)
+			a.mu.Unlock()
+		}()
+		next(as)
+	}
+}
+
+type adminConnInfo struct {
+	ID            int64              `json:"id"`
+	User          string             `json:"user,omitempty"`
+	Remote        string             `json:"remote"`
+	Local         string             `json:"local"`
+	AuthMethod    string             `json:"auth_method,omitempty"`
+	ClientVersion string             `json:"client_version,omitempty"`
+	Start         time.Time          `json:"start"`
+	BytesRead     int64              `json:"bytes_read"`
+	BytesWritten  int64              `json:"bytes_written"`
+	Sessions      []adminSessionInfo `json:"sessions"`
+}
+
+type adminSessionInfo struct {
+	ID           int64     `json:"id"`
+	Connection   int64     `json:"connection"`
+	User         string    `json:"user"`
+	Remote       string    `json:"remote"`
+	Start        time.Time `json:"start"`
+	Command      string    `json:"command,omitempty"`
+	Subsystem    string    `json:"subsystem,omitempty"`
+	Pty          bool      `json:"pty"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+}
+
+func (c *adminConn) info() adminConnInfo {
+	c.mu.Lock()
+	methods := strings.Join(c.methods, "+")
+	c.mu.Unlock()
+	user, _ := c.ctx.Value(ssh.ContextKeyUser).(string)
+	version, _ := c.ctx.Value(ssh.ContextKeyClientVersion).(string)
+	return adminConnInfo{
+		ID:            c.id,
+		User:          user,
+		Remote:        c.RemoteAddr().String(),
+		Local:         c.LocalAddr().String(),
+		AuthMethod:    methods,
+		ClientVersion: version,
+		Start:         c.start,
+		BytesRead:     c.read.Load(),
+		BytesWritten:  c.written.Load(),
+		Sessions:      []adminSessionInfo{},
+	}
+}
+
+func (s *adminSession) info() adminSessionInfo {
+	_, _, isPty := s.Pty()
+	info := adminSessionInfo{
+		ID:           s.id,
+		User:         s.User(),
+		Remote:       s.RemoteAddr().String(),
+		Start:        s.start,
+		Command:      s.RawCommand(),
+		Subsystem:    s.Subsystem(),
+		Pty:          isPty,
+		BytesRead:    s.read.Load(),
+		BytesWritten: s.written.Load(),
+	}
+	if s.conn != nil {
+		info.Connection = s.conn.id
+	}
+	return info
+}
+
+func (a *sshdAdmin) snapshot() ([]adminConnInfo, []adminSessionInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	conns := []adminConnInfo{}
+	index := make(map[int64]int)
+	for _, c := range a.conns {
+		index[c.id] = len(conns)
+		conns = append(conns, c.info())
+	}
+	sessions := []adminSessionInfo{}
+	for _, s := range a.sessions {
+		info := s.info()
+		sessions = append(sessions, info)
+		if i, ok := index[info.Connection]; ok {
+			conns[i].Sessions = append(conns[i].Sessions, info)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	for _, c := range conns {
+		sort.Slice(c.Sessions, func(i, j int) bool { return c.Sessions[i].ID < c.Sessions[j].ID })
+	}
+	return conns, sessions
+}
+
+// requireToken refuses requests to next that do not carry token.
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *sshdAdmin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, r *http.Request) {
+		conns, _ := a.snapshot()
+		writeJSON(w, conns)
+	})
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		_, sessions := a.snapshot()
+		writeJSON(w, sessions)
+	})
+	mux.HandleFunc("DELETE /connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		a.mu.Lock()
+		c := a.conns[id]
+		a.mu.Unlock()
+		if c == nil {
+			http.Error(w, "no such connection", http.StatusNotFound)
+			return
+		}
+		log.Printf("Admin API closing connection %d from %s", id, c.RemoteAddr())
+		audit(c.ctx, auditEvent{Event: "admin_close"})
+		c.Close()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		a.mu.Lock()
+		s := a.sessions[id]
+		a.mu.Unlock()
+		if s == nil {
+			http.Error(w, "no such session", http.StatusNotFound)
+			return
+		}
+		log.Printf("Admin API terminating session %d of %s@%s", id, s.User(), s.RemoteAddr())
+		audit(s.Context(), auditEvent{Event: "admin_terminate", Command: s.RawCommand()})
+		s.terminate()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// serve serves the admin API on addr, a loopback host:port or
+// unix:/path of a socket only accessible to the current user. Other local
+// users can reach a host:port, so it requires the token read from
+// tokenFile.
+func (a *sshdAdmin) serve(addr, tokenFile string) error {
+	handler := a.handler()
+	if !strings.HasPrefix(addr, "unix:") {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("admin API address %s is not a loopback address", addr)
+		}
+		if tokenFile == "" {
+			return fmt.Errorf("admin API address %s needs -admin-token-file", addr)
+		}
+		token, err := readAdminToken(tokenFile)
+		if err != nil {
+			return err
+		}
+		handler = requireToken(token, handler)
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		// the socket is created for the user only, rather than changed
+		// after others had a chance to connect
+		defer syscall.Umask(syscall.Umask(0177))
+	}
+	l, err := listenAddress(addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Admin API on %s", addr)
+	go func() {
+		log.Printf("Admin API stopped: %s", http.Serve(l, handler))
+	}()
+	return nil
+}
+
+// readAdminToken reads the admin API token from the first line of fileName.
+func readAdminToken(fileName string) (string, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	token, _, _ := strings.Cut(string(b), "\n")
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("%s: no admin API token", fileName)
+	}
+	return token, nil
+}
+
+// isAdminTarget reports whether a local forward to host:port, or to the
+// socket path when port is 0, could reach the admin API, which SSH users
+// must not be able to use. As the API only listens on loopback, host names
+// are refused on its port too rather than resolved, since what they
+// resolve to can change before the forward dials them.
+func isAdminTarget(opts *sshdOptions, host string, port uint32) bool {
+	if opts.AdminListen == "" {
+		return false
+	}
+	if socket, ok := strings.CutPrefix(opts.AdminListen, "unix:"); ok {
+		return port == 0 && path.Clean(host) == path.Clean(socket)
+	}
+	_, adminPort, err := net.SplitHostPort(opts.AdminListen)
+	if err != nil || adminPort != strconv.Itoa(int(port)) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || ip.IsLoopback() || ip.IsUnspecified()
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// Named sessions keep a shell running on its PTY after the client
+// disconnects. `ssh -t host attach NAME` starts the session NAME or joins
+// it when it is already running, showing its recent output first; several
+// clients can be attached at once. `ssh host sessions` lists the sessions
+// of the user.
+
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// isAttachCommand reports whether args is one of the named session
+// commands.
+func isAttachCommand(args []string) bool {
+	return len(args) > 0 && (args[0] == "attach" || args[0] == "sessions")
+}
+
+// sessionManager holds the named sessions of all users.
+type sessionManager struct {
+	opts       *sshdOptions
+	scrollback int
+
+	mu       sync.Mutex
+	sessions map[string]*namedSession // by user and name
+}
+
+func newSessionManager(opts *sshdOptions) *sessionManager {
+	return &sessionManager{
+		opts:       opts,
+		scrollback: opts.Scrollback,
+		sessions:   make(map[string]*namedSession),
+	}
+}
+
+// namedSession is a shell on a PTY that outlives the connection that
+// started it.
+type namedSession struct {
+	name    string
+	user    string
+	command string
+	created time.Time
+	cmd     *exec.Cmd
+	ptmx    *os.File
+	done    chan struct{}
+	err     error
+
+	mu         sync.Mutex
+	limit      int
+	scrollback []byte
+	viewers    map[*sessionViewer]struct{}
+	rec        *asciicastWriter
+}
+
+// viewerQueue is how many writes of output a client attached to a named
+// session may fall behind before it is detached.
+const viewerQueue = 256
+
+// sessionViewer sends the output of a named session to an attached client
+// from a goroutine of its own, so that a stalled client does not hold up
+// the session and the other clients.
+type sessionViewer struct {
+	s       ssh.Session
+	queue   chan []byte
+	dropped chan struct{} // closed when the client fell behind
+	flushed chan struct{} // closed when the queue is written out
+}
+
+func (v *sessionViewer) run() {
+	defer close(v.flushed)
+	for p := range v.queue {
+		v.s.Write(p)
+	}
+}
+
+// run serves an attach or sessions command and returns the exit status.
+// A new session runs cmd.
+func (m *sessionManager) run(s ssh.Session, args []string, cmd *exec.Cmd) int {
+	if args[0] == "sessions" {
+		m.list(s, s.User())
+		return 0
+	}
+	if len(args) != 2 || !sessionNamePattern.MatchString(args[1]) {
+		fmt.Fprintf(s.Stderr(), "usage: attach NAME (letters, digits, '.', '_' and '-')\r\n")
+		m.list(s.Stderr(), s.User())
+		return 2
+	}
+	if _, _, isPty := s.Pty(); !isPty {
+		fmt.Fprintf(s.Stderr(), "attach needs a terminal, use ssh -t\n")
+		return 1
+	}
+
+	ns, err := m.open(s, args[1], cmd)
+	if err != nil {
+		fmt.Fprintf(s.Stderr(), "%s\r\n", err)
+		return 1
+	}
+	return ns.attach(s)
+}
+
+// list writes a table of the sessions of user to w.
+func (m *sessionManager) list(w io.Writer, user string) {
+	m.mu.Lock()
+	var sessions []*namedSession
+	for _, ns := range m.sessions {
+		if ns.user == user {
+			sessions = append(sessions, ns)
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].name < sessions[j].name })
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tCREATED\tCLIENTS\tCOMMAND\r\n")
+	for _, ns := range sessions {
+		ns.mu.Lock()
+		viewers := len(ns.viewers)
+		ns.mu.Unlock()
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\r\n", ns.name, ns.created.Format("2006-01-02 15:04:05"), viewers, ns.command)
+	}
+	tw.Flush()
+}
+
+// open returns the running session name of the user, or starts cmd as a
+// new one. The process of a named session is not tied to the connection
+// that started it.
+func (m *sessionManager) open(s ssh.Session, name string, cmd *exec.Cmd) (*namedSession, error) {
+	key := s.User() + "/" + name
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ns := m.sessions[key]; ns != nil {
+		return ns, nil
+	}
+
+	ptyReq, _, _ := s.Pty()
+	ptmx, err := startPty(cmd, ptyReq)
+	if err != nil {
+		return nil, err
+	}
+	ns := &namedSession{
+		name:    name,
+		user:    s.User(),
+		command: cmd.Args[len(cmd.Args)-1],
+		created: time.Now(),
+		cmd:     cmd,
+		ptmx:    ptmx,
+		done:    make(chan struct{}),
+		limit:   m.scrollback,
+		viewers: make(map[*sessionViewer]struct{}),
+		rec:     startRecording(m.opts, s, cmd),
+	}
+	m.sessions[key] = ns
+	log.Printf("Started session %s of %s", name, s.User())
+
+	go func() {
+		ns.copyOutput()
+		ns.err = cmd.Wait()
+		m.mu.Lock()
+		delete(m.sessions, key)
+		m.mu.Unlock()
+		log.Printf("Session %s of %s ended: %v", name, ns.user, ns.err)
+		close(ns.done)
+	}()
+	return ns, nil
+}
+
+// copyOutput sends the output of the session to the attached clients and
+// keeps the last part of it for clients attaching later.
+func (ns *namedSession) copyOutput() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := ns.ptmx.Read(buf)
+		if n > 0 {
+			ns.output(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.ptmx.Close()
+	if ns.rec != nil {
+		ns.rec.Close()
+	}
+}
+
+func (ns *namedSession) output(p []byte) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	ns.scrollback = append(ns.scrollback, p...)
+	if len(ns.scrollback) > ns.limit {
+		ns.scrollback = append([]byte(nil), ns.scrollback[len(ns.scrollback)-ns.limit:]...)
+	}
+	if len(ns.viewers) > 0 {
+		p = append([]byte(nil), p...)
+	}
+	for v := range ns.viewers {
+		select {
+		case v.queue <- p:
+		default:
+			delete(ns.viewers, v)
+			close(v.queue)
+			close(v.dropped)
+		}
+	}
+	if ns.rec != nil {
+		ns.rec.Write(p)
+	}
+}
+
+// attach shows the session on s until the client detaches by closing the
+// connection or the session ends, and returns the exit status.
+func (ns *namedSession) attach(s ssh.Session) int {
+	ptyReq, winCh, _ := s.Pty()
+	v := &sessionViewer{
+		s:       s,
+		queue:   make(chan []byte, viewerQueue),
+		dropped: make(chan struct{}),
+		flushed: make(chan struct{}),
+	}
+
+	ns.mu.Lock()
+	if len(ns.scrollback) > 0 {
+		v.queue <- append([]byte(nil), ns.scrollback...)
+	}
+	ns.viewers[v] = struct{}{}
+	viewers := len(ns.viewers)
+	ns.mu.Unlock()
+	go v.run()
+	log.Printf("%s@%s attached to session %s (%d clients)", s.User(), s.RemoteAddr(), ns.name, viewers)
+
+	detach := func() {
+		ns.mu.Lock()
+		defer ns.mu.Unlock()
+		if _, ok := ns.viewers[v]; ok {
+			delete(ns.viewers, v)
+			close(v.queue)
+		}
+	}
+	defer detach()
+
+	// the size of the client that attached or resized last wins
+	ns.resize(ptyReq.Window)
+	go func() {
+		for win := range winCh {
+			ns.resize(win)
+		}
+	}()
+	input := make(chan struct{})
+	go func() {
+		io.Copy(ns.ptmx, s)
+		close(input)
+	}()
+
+	select {
+	case <-ns.done:
+		detach()
+		<-v.flushed
+		fmt.Fprintf(s, "\r\n[session %s ended]\r\n", ns.name)
+		return exitStatus(ns.err)
+	case <-v.dropped:
+		log.Printf("%s@%s too slow, detaching from session %s", s.User(), s.RemoteAddr(), ns.name)
+		return 0
+	case <-input:
+	case <-s.Context().Done():
+	}
+	log.Printf("%s@%s detached from session %s", s.User(), s.RemoteAddr(), ns.name)
+	return 0
+}
+
+func (ns *namedSession) resize(win ssh.Window) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	select {
+	case <-ns.done:
+		return
+	default:
+	}
+	setWinsize(ns.ptmx, win.Width, win.Height)
+	if ns.rec != nil {
+		ns.rec.Resize(win.Width, win.Height)
+	}
+}
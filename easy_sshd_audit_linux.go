@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	contextKeyAudit      = &sshdContextKey{"audit"}
+	contextKeyAuditLogin = &sshdContextKey{"audit-login"}
+	contextKeyOfferedKey = &sshdContextKey{"offered-key"}
+	contextKeyAuthMethod = &sshdContextKey{"auth-method"}
+)
+
+// auditLog writes one JSON object per line for every security relevant
+// action: connections, logins, commands, forwards and file changes.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// auditEvent is a line of the audit log. Fields that do not apply to an
+// event are left out.
+type auditEvent struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	Session      string    `json:"session,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Remote       string    `json:"remote,omitempty"`
+	Method       string    `json:"method,omitempty"`
+	Fingerprint  string    `json:"fingerprint,omitempty"`
+	Command      string    `json:"command,omitempty"`
+	Status       *int      `json:"status,omitempty"`
+	Signal       string    `json:"signal,omitempty"`
+	Path         string    `json:"path,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	Flags        string    `json:"flags,omitempty"`
+	BytesRead    int64     `json:"bytes_read,omitempty"`
+	BytesWritten int64     `json:"bytes_written,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+func openAuditLog(fileName string) (*auditLog, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{enc: json.NewEncoder(f)}, nil
+}
+
+func (a *auditLog) write(ev auditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.enc.Encode(ev); err != nil {
+		log.Printf("audit log: %s", err)
+	}
+}
+
+// audit records ev for the connection of ctx, filling in the time and the
+// connection details. It does nothing when no audit log is configured.
+func audit(ctx ssh.Context, ev auditEvent) {
+	a, _ := ctx.Value(contextKeyAudit).(*auditLog)
+	if a == nil {
+		return
+	}
+	ev.Time = time.Now()
+	// the session id and user are only known after the handshake
+	ev.Session, _ = ctx.Value(ssh.ContextKeySessionID).(string)
+	if ev.User == "" {
+		ev.User, _ = ctx.Value(ssh.ContextKeyUser).(string)
+	}
+	if ev.Remote == "" && ctx.RemoteAddr() != nil {
+		ev.Remote = ctx.RemoteAddr().String()
+	}
+	a.write(ev)
+}
+
+// auditConn records the end of a connection when it is closed.
+type auditConn struct {
+	net.Conn
+	ctx  ssh.Context
+	once sync.Once
+}
+
+func (c *auditConn) Close() error {
+	c.once.Do(func() {
+		if conn, ok := c.ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn); ok {
+			auditLogin(c.ctx, conn)
+		}
+		audit(c.ctx, auditEvent{Event: "disconnect"})
+	})
+	return c.Conn.Close()
+}
+
+// connCallback attaches the audit log to a new connection and records it.
+func (a *auditLog) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	ctx.SetValue(contextKeyAudit, a)
+	ctx.SetValue(contextKeyAuditLogin, new(sync.Once))
+	audit(ctx, auditEvent{Event: "connect", Remote: conn.RemoteAddr().String()})
+	return &auditConn{Conn: conn, ctx: ctx}
+}
+
+// auditPublicKeyHandler remembers the key a client offers so that a failed
+// attempt can be logged with its fingerprint.
+func auditPublicKeyHandler(next ssh.PublicKeyHandler) ssh.PublicKeyHandler {
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		ctx.SetValue(contextKeyOfferedKey, key)
+		return next(ctx, key)
+	}
+}
+
+// auditAuth records failed and partially successful authentication
+// attempts. It is called from the server's AuthLogCallback. Successful
+// logins are left to auditLogin, as the ssh package does not necessarily
+// pass the key a client signs with to the callbacks again.
+func auditAuth(ctx ssh.Context, conn gossh.ConnMetadata, method string, err error) {
+	if method == "none" {
+		return
+	}
+	if err == nil {
+		ctx.SetValue(contextKeyAuthMethod, method)
+		return
+	}
+	ev := auditEvent{
+		Event:  "auth_failure",
+		User:   conn.User(),
+		Remote: conn.RemoteAddr().String(),
+		Method: method,
+	}
+	var partial *gossh.PartialSuccessError
+	if errors.As(err, &partial) {
+		ev.Event = "auth_partial"
+	} else {
+		ev.Error = err.Error()
+	}
+	if key, ok := ctx.Value(contextKeyOfferedKey).(ssh.PublicKey); ok && method == "publickey" {
+		ev.Fingerprint = gossh.FingerprintSHA256(key)
+	}
+	audit(ctx, ev)
+}
+
+// auditLogin records the successful login of conn once, with the user and
+// key named by the permissions it ended up with.
+func auditLogin(ctx ssh.Context, conn *gossh.ServerConn) {
+	once, _ := ctx.Value(contextKeyAuditLogin).(*sync.Once)
+	if once == nil {
+		return
+	}
+	once.Do(func() {
+		method, _ := ctx.Value(contextKeyAuthMethod).(string)
+		audit(ctx, auditEvent{
+			Event:       "auth_success",
+			User:        conn.Permissions.Extensions[permissionUser],
+			Method:      method,
+			Fingerprint: conn.Permissions.Extensions[permissionFingerprint],
+		})
+	})
+}
+
+// auditFile counts the bytes transferred through an SFTP file handle and
+// records them when the client closes it.
+type auditFile struct {
+	*os.File
+	ctx        ssh.Context
+	clientPath string
+	read       int64
+	written    int64
+}
+
+func (f *auditFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	atomic.AddInt64(&f.read, int64(n))
+	return n, err
+}
+
+func (f *auditFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	atomic.AddInt64(&f.written, int64(n))
+	return n, err
+}
+
+func (f *auditFile) Close() error {
+	err := f.File.Close()
+	audit(f.ctx, auditEvent{
+		Event:        "sftp_close",
+		Path:         f.clientPath,
+		BytesRead:    atomic.LoadInt64(&f.read),
+		BytesWritten: atomic.LoadInt64(&f.written),
+	})
+	return err
+}
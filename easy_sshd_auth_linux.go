@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is a single entry of an OpenSSH authorized_keys file
+// together with the options that restrict it.
+type authorizedKey struct {
+	Key     gossh.PublicKey
+	Comment string
+	From    []string
+	Command string
+	NoPty   bool
+
+	NoPortForwarding  bool
+	NoAgentForwarding bool
+	PermitOpen        []string
+	PermitListen      []string
+}
+
+var contextKeyAuthorizedKey = &sshdContextKey{"authorized-key"}
+
+func defaultAuthorizedKeysPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".ssh", "authorized_keys")
+}
+
+// loadAuthorizedKeys reads an OpenSSH authorized_keys file. A missing file
+// yields no keys and no error.
+func loadAuthorizedKeys(fileName string) ([]*authorizedKey, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseAuthorizedKeys(data), nil
+}
+
+// parseAuthorizedKeys parses authorized_keys lines, skipping the ones that
+// cannot be used.
+func parseAuthorizedKeys(data []byte) []*authorizedKey {
+	var keys []*authorizedKey
+	for len(data) > 0 {
+		pubKey, comment, options, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+
+		ak, err := parseAuthorizedKeyOptions(options)
+		if err != nil {
+			log.Printf("skip authorized key %s (%s): %s", gossh.FingerprintSHA256(pubKey), comment, err)
+			continue
+		}
+		ak.Key = pubKey
+		ak.Comment = comment
+		keys = append(keys, ak)
+	}
+	return keys
+}
+
+func parseAuthorizedKeyOptions(options []string) (*authorizedKey, error) {
+	ak := &authorizedKey{}
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		if hasValue {
+			var err error
+			value, err = unquoteKeyOption(value)
+			if err != nil {
+				return nil, fmt.Errorf("option %s: %w", name, err)
+			}
+		}
+		switch strings.ToLower(name) {
+		case "from":
+			ak.From = strings.Split(value, ",")
+		case "command":
+			ak.Command = value
+		case "no-pty":
+			ak.NoPty = true
+		case "restrict":
+			ak.NoPty = true
+			ak.NoPortForwarding = true
+			ak.NoAgentForwarding = true
+		case "pty":
+			ak.NoPty = false
+		case "no-port-forwarding":
+			ak.NoPortForwarding = true
+		case "port-forwarding":
+			ak.NoPortForwarding = false
+		case "no-agent-forwarding":
+			ak.NoAgentForwarding = true
+		case "agent-forwarding":
+			ak.NoAgentForwarding = false
+		case "permitopen":
+			ak.PermitOpen = append(ak.PermitOpen, value)
+		case "permitlisten":
+			ak.PermitListen = append(ak.PermitListen, value)
+		case "no-user-rc", "no-x11-forwarding", "user-rc", "x11-forwarding":
+			// user rc files and X11 forwarding are never provided
+		default:
+			// like OpenSSH, refuse keys whose restrictions cannot be
+			// enforced, e.g. expiry-time, principals or cert-authority
+			return nil, fmt.Errorf("unsupported option %s", name)
+		}
+	}
+	return ak, nil
+}
+
+func unquoteKeyOption(value string) (string, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return "", fmt.Errorf("value must be quoted")
+	}
+	return strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`), nil
+}
+
+// matchFromPatterns reports whether addr is allowed by an OpenSSH from="..."
+// pattern list. Patterns may use * and ? wildcards, CIDR notation and a
+// leading ! to negate.
+func matchFromPatterns(patterns []string, addr net.Addr) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+			ok = ip != nil && ipNet.Contains(ip)
+		} else {
+			ok, _ = path.Match(pattern, host)
+		}
+		if ok && negate {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// Extensions of the permissions the authentication callbacks return,
+// naming the user and key a connection logs in with.
+const (
+	permissionUser        = "easy-sshd-user"
+	permissionFingerprint = "easy-sshd-fingerprint"
+)
+
+// acceptedKeys are the keys the public key handler accepted on a
+// connection, by user and fingerprint. The handler also runs for keys that
+// clients only query, so which of them a connection logged in with is only
+// known from its permissions once the handshake is done.
+type acceptedKeys map[string]*authorizedKey
+
+var contextKeyAcceptedKeys = &sshdContextKey{"accepted-keys"}
+
+func acceptKey(ctx ssh.Context, ak *authorizedKey) {
+	keys, _ := ctx.Value(contextKeyAcceptedKeys).(acceptedKeys)
+	if keys == nil {
+		keys = make(acceptedKeys)
+		ctx.SetValue(contextKeyAcceptedKeys, keys)
+	}
+	keys[ctx.User()+" "+gossh.FingerprintSHA256(ak.Key)] = ak
+}
+
+// publicKeyHandler returns a handler accepting the authorized keys of the
+// user logging in and, when certs is set, certificates of the trusted CAs
+// naming the user as principal. Keys in revoked are always refused.
+func publicKeyHandler(users map[string]*sshdUser, certs *userCertChecker, revoked *keyRevocationList) ssh.PublicKeyHandler {
+	return func(ctx ssh.Context, key ssh.PublicKey) bool {
+		u := users[ctx.User()]
+		if u == nil {
+			return false
+		}
+		if revoked.revoked(key) {
+			log.Printf("key %s rejected for %s: revoked", gossh.FingerprintSHA256(key), ctx.RemoteAddr())
+			return false
+		}
+		if cert, ok := key.(*gossh.Certificate); ok {
+			if certs == nil {
+				return false
+			}
+			ak, err := certs.check(ctx.User(), cert)
+			if err != nil {
+				log.Printf("certificate %q rejected for %s: %s", cert.KeyId, ctx.RemoteAddr(), err)
+				return false
+			}
+			acceptKey(ctx, ak)
+			return true
+		}
+		for _, ak := range u.keys {
+			if !ssh.KeysEqual(ak.Key, key) {
+				continue
+			}
+			if len(ak.From) > 0 && !matchFromPatterns(ak.From, ctx.RemoteAddr()) {
+				log.Printf("key %s rejected for %s: from restriction", gossh.FingerprintSHA256(key), ctx.RemoteAddr())
+				return false
+			}
+			acceptKey(ctx, ak)
+			return true
+		}
+		return false
+	}
+}
+
+// passwordHandler returns a handler checking the password of the user
+// logging in.
+func passwordHandler(users map[string]*sshdUser) ssh.PasswordHandler {
+	return func(ctx ssh.Context, password string) bool {
+		u := users[ctx.User()]
+		return u != nil && u.checkPassword(password)
+	}
+}
+
+// authenticated stores the user and key the connection logged in with in
+// ctx, as named by the permissions it ended up with. It reports false when
+// the key is unknown, which cannot happen unless the callbacks are broken.
+func authenticated(ctx ssh.Context, conn *gossh.ServerConn) bool {
+	auditLogin(ctx, conn)
+	name := conn.Permissions.Extensions[permissionUser]
+	ctx.SetValue(ssh.ContextKeyUser, name)
+	ctx.SetValue(contextKeyUser, connCredentials(ctx).users[name])
+
+	var ak *authorizedKey
+	if fp := conn.Permissions.Extensions[permissionFingerprint]; fp != "" {
+		keys, _ := ctx.Value(contextKeyAcceptedKeys).(acceptedKeys)
+		if ak = keys[name+" "+fp]; ak == nil {
+			log.Printf("no accepted key %s for %s", fp, name)
+			return false
+		}
+		ctx.SetValue(ssh.ContextKeyPublicKey, ak.Key)
+	}
+	ctx.SetValue(contextKeyAuthorizedKey, ak)
+	return true
+}
+
+// afterAuthChannel and afterAuthRequest wrap the handlers of a server so
+// that the user and key of the connection are known to them.
+func afterAuthChannel(next ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		if !authenticated(ctx, conn) {
+			newChan.Reject(gossh.Prohibited, "unknown key")
+			return
+		}
+		next(srv, conn, newChan, ctx)
+	}
+}
+
+func afterAuthRequest(next ssh.RequestHandler) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		if !authenticated(ctx, ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)) {
+			return false, nil
+		}
+		return next(ctx, srv, req)
+	}
+}
+
+func sessionAuthorizedKey(ctx ssh.Context) *authorizedKey {
+	ak, _ := ctx.Value(contextKeyAuthorizedKey).(*authorizedKey)
+	return ak
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	key := strings.TrimSpace(string(marshalTestKey(t, 1)))
+	tests := []struct {
+		options string
+		want    *authorizedKey // nil when the key is skipped
+	}{
+		{"", &authorizedKey{}},
+		{`command="echo \"forced\""`, &authorizedKey{Command: `echo "forced"`}},
+		{`from="192.0.2.0/24,!192.0.2.1,*.example.com"`, &authorizedKey{From: []string{"192.0.2.0/24", "!192.0.2.1", "*.example.com"}}},
+		{"no-pty,no-port-forwarding,no-agent-forwarding", &authorizedKey{NoPty: true, NoPortForwarding: true, NoAgentForwarding: true}},
+		{"restrict", &authorizedKey{NoPty: true, NoPortForwarding: true, NoAgentForwarding: true}},
+		{"restrict,pty,port-forwarding", &authorizedKey{NoAgentForwarding: true}},
+		{`RESTRICT,Agent-Forwarding`, &authorizedKey{NoPty: true, NoPortForwarding: true}},
+		{`permitopen="localhost:80",permitopen="/run/app.sock",permitlisten="8080"`, &authorizedKey{PermitOpen: []string{"localhost:80", "/run/app.sock"}, PermitListen: []string{"8080"}}},
+		{"no-user-rc,no-x11-forwarding,user-rc,x11-forwarding", &authorizedKey{}},
+		{`expiry-time="20300101"`, nil},
+		{`principals="alice"`, nil},
+		{"cert-authority", nil},
+		{`environment="A=B"`, nil},
+		{"no-touch-required", nil},
+		{"command=unquoted", nil},
+	}
+	for _, tt := range tests {
+		line := key
+		if tt.options != "" {
+			line = tt.options + " " + key
+		}
+		keys := parseAuthorizedKeys([]byte(line + " comment\n"))
+		if tt.want == nil {
+			if len(keys) != 0 {
+				t.Errorf("%s: key not skipped", tt.options)
+			}
+			continue
+		}
+		if len(keys) != 1 {
+			t.Errorf("%s: %d keys, want 1", tt.options, len(keys))
+			continue
+		}
+		got := keys[0]
+		if got.Comment != "comment" || string(got.Key.Marshal()) != string(testSigner(t, 1).PublicKey().Marshal()) {
+			t.Errorf("%s: key %s (%s)", tt.options, got.Key.Type(), got.Comment)
+		}
+		got.Key, got.Comment = nil, ""
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.options, got, tt.want)
+		}
+	}
+}
+
+// A skipped line must not take the keys after it along.
+func TestParseAuthorizedKeysSkipsLine(t *testing.T) {
+	data := "# keys\n" +
+		"principals=\"alice\" " + string(marshalTestKey(t, 1)) +
+		"no-pty " + string(marshalTestKey(t, 2))
+	keys := parseAuthorizedKeys([]byte(data))
+	if len(keys) != 1 || !keys[0].NoPty || string(keys[0].Key.Marshal()) != string(testSigner(t, 2).PublicKey().Marshal()) {
+		t.Errorf("got %d keys, want the second key only", len(keys))
+	}
+}
+
+func TestMatchFromPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		addr     string
+		match    bool
+	}{
+		{[]string{"192.0.2.0/24"}, "192.0.2.7:1234", true},
+		{[]string{"192.0.2.0/24"}, "198.51.100.7:1234", false},
+		{[]string{"192.0.2.*"}, "192.0.2.7:1234", true},
+		{[]string{"192.0.2.0/24", "!192.0.2.7"}, "192.0.2.7:1234", false},
+		{[]string{"!192.0.2.7", "192.0.2.0/24"}, "192.0.2.8:1234", true},
+		{[]string{"!192.0.2.7"}, "192.0.2.8:1234", false},
+		{[]string{"2001:db8::/32"}, "[2001:db8::1]:1234", true},
+		{[]string{" 192.0.2.7 "}, "192.0.2.7:1234", true},
+	}
+	for _, tt := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchFromPatterns(tt.patterns, addr); got != tt.match {
+			t.Errorf("matchFromPatterns(%q, %s) = %v, want %v", tt.patterns, tt.addr, got, tt.match)
+		}
+	}
+}
+
+func marshalTestKey(t *testing.T, seed byte) []byte {
+	return gossh.MarshalAuthorizedKey(testSigner(t, seed).PublicKey())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	osuser "os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+)
+
+const defaultLoginPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// homeDir returns the home directory of u: the configured one, the one of
+// the system account with the same name, or the home of the server process.
+func (u *sshdUser) homeDir() string {
+	if u.Home != "" {
+		return u.Home
+	}
+	if account, err := osuser.Lookup(u.Name); err == nil && account.HomeDir != "" {
+		return account.HomeDir
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	return "/"
+}
+
+// shell returns the program of the user's login command when it is an
+// absolute path, the SHELL of the server otherwise.
+func (u *sshdUser) shell() string {
+	if fields := strings.Fields(u.Command); len(fields) > 0 && filepath.IsAbs(fields[0]) {
+		return fields[0]
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+// loginEnviron builds the environment of a session: the login variables,
+// then the client's variables allowed by -accept-env, then the user's
+// configured environment.
+func loginEnviron(opts *sshdOptions, s ssh.Session, u *sshdUser) []string {
+	loginPath := os.Getenv("PATH")
+	if loginPath == "" {
+		loginPath = defaultLoginPath
+	}
+	clientHost, clientPort := splitAddr(s.RemoteAddr())
+	serverHost, serverPort := splitAddr(s.LocalAddr())
+
+	env := []string{
+		"HOME=" + u.homeDir(),
+		"USER=" + u.Name,
+		"LOGNAME=" + u.Name,
+		"SHELL=" + u.shell(),
+		"PATH=" + loginPath,
+		fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", clientHost, clientPort, serverHost, serverPort),
+		fmt.Sprintf("SSH_CLIENT=%s %s %s", clientHost, clientPort, serverPort),
+	}
+	for _, kv := range s.Environ() {
+		if name, _, ok := strings.Cut(kv, "="); ok && acceptEnv(opts.AcceptEnv, name) {
+			env = append(env, kv)
+		}
+	}
+	return append(env, u.environ()...)
+}
+
+// acceptEnv reports whether the client may set the variable name. patterns
+// is a comma separated list that may use * and ? wildcards.
+func acceptEnv(patterns string, name string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		if ok, _ := path.Match(strings.TrimSpace(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitAddr(addr net.Addr) (string, string) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), "0"
+	}
+	return host, port
+}
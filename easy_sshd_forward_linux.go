@@ -0,0 +1,389 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// localForwardingCallback allows `ssh -L` to destinations matching the
+// -permit-open list, or any destination when the list is empty, except the
+// admin API.
+func localForwardingCallback(opts *sshdOptions) ssh.LocalPortForwardingCallback {
+	return func(ctx ssh.Context, host string, port uint32) bool {
+		ok := !isAdminTarget(opts, host, port) && forwardAllowed(ctx, opts.AllowLocalForwarding, opts.PermitOpen, localKeyPermits, func(patterns []string) bool {
+			return matchHostPort(patterns, host, port)
+		})
+		logForward(ctx, "local", net.JoinHostPort(host, strconv.Itoa(int(port))), ok)
+		return ok
+	}
+}
+
+// reverseForwardingCallback allows `ssh -R` to bind addresses matching the
+// -permit-listen list, or any address when the list is empty.
+func reverseForwardingCallback(opts *sshdOptions) ssh.ReversePortForwardingCallback {
+	return func(ctx ssh.Context, host string, port uint32) bool {
+		ok := forwardAllowed(ctx, opts.AllowRemoteForwarding, opts.PermitListen, remoteKeyPermits, func(patterns []string) bool {
+			return matchHostPort(patterns, host, port)
+		})
+		logForward(ctx, "remote", net.JoinHostPort(host, strconv.Itoa(int(port))), ok)
+		return ok
+	}
+}
+
+// logForward records a forwarding request and the decision on it.
+func logForward(ctx ssh.Context, direction, target string, ok bool) {
+	if direction == "local" {
+		log.Printf("%s@%s local forward to %s allowed=%v", ctx.User(), ctx.RemoteAddr(), target, ok)
+	} else {
+		log.Printf("%s@%s remote forward on %s allowed=%v", ctx.User(), ctx.RemoteAddr(), target, ok)
+	}
+	ev := auditEvent{Event: direction + "_forward", Target: target}
+	if !ok {
+		ev.Error = "denied"
+	}
+	audit(ctx, ev)
+}
+
+func localKeyPermits(ak *authorizedKey) []string  { return ak.PermitOpen }
+func remoteKeyPermits(ak *authorizedKey) []string { return ak.PermitListen }
+
+// forwardAllowed applies the forwarding policy: forwarding must be enabled,
+// not refused by the authorized key, and the target must match both the
+// global allow-list and the key's own list when they are not empty.
+func forwardAllowed(ctx ssh.Context, enabled bool, permits []string, keyPermits func(*authorizedKey) []string, match func([]string) bool) bool {
+	if !enabled {
+		return false
+	}
+	if len(permits) > 0 && !match(permits) {
+		return false
+	}
+	if ak := sessionAuthorizedKey(ctx); ak != nil {
+		if ak.NoPortForwarding {
+			return false
+		}
+		if len(keyPermits(ak)) > 0 && !match(keyPermits(ak)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHostPort reports whether host:port matches one of the patterns. A
+// pattern is host:port where the host may contain * and ? wildcards and the
+// port may be *. A pattern without a port matches only the port. Socket
+// path patterns are ignored.
+func matchHostPort(patterns []string, host string, port uint32) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "/") {
+			continue
+		}
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			patternHost, patternPort = "*", pattern
+		}
+		if patternPort != "*" && patternPort != strconv.Itoa(int(port)) {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(patternHost), strings.ToLower(host)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSocketPath reports whether the Unix socket path matches one of the
+// absolute path patterns, which may contain * and ? wildcards.
+func matchSocketPath(patterns []string, socketPath string) bool {
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "/") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, path.Clean(socketPath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	forwardedTCPChannelType         = "forwarded-tcpip"
+	forwardedStreamLocalChannelType = "forwarded-streamlocal@openssh.com"
+)
+
+type remoteTCPForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type remoteTCPForwardSuccess struct {
+	BindPort uint32
+}
+
+// forwarded-tcpip channel data
+type remoteTCPForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// direct-streamlocal@openssh.com channel data
+type localStreamForwardChannelData struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+type remoteStreamForwardRequest struct {
+	SocketPath string
+}
+
+// forwarded-streamlocal@openssh.com channel data
+type remoteStreamForwardChannelData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// directStreamLocalHandler serves `ssh -L port:/path/to.sock`. It can be
+// added to the server's ChannelHandlers under direct-streamlocal@openssh.com.
+func directStreamLocalHandler(opts *sshdOptions) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		d := localStreamForwardChannelData{}
+		if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+			newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+			return
+		}
+
+		ok := !isAdminTarget(opts, d.SocketPath, 0) && forwardAllowed(ctx, opts.AllowLocalForwarding, opts.PermitOpen, localKeyPermits, func(patterns []string) bool {
+			return matchSocketPath(patterns, d.SocketPath)
+		})
+		logForward(ctx, "local", d.SocketPath, ok)
+		if !ok {
+			newChan.Reject(gossh.Prohibited, "streamlocal forwarding is disabled")
+			return
+		}
+
+		var dialer net.Dialer
+		dconn, err := dialer.DialContext(ctx, "unix", d.SocketPath)
+		if err != nil {
+			newChan.Reject(gossh.ConnectionFailed, err.Error())
+			return
+		}
+
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			dconn.Close()
+			return
+		}
+		go gossh.DiscardRequests(reqs)
+		bridgeConn(ch, dconn)
+	}
+}
+
+// forwardedTCPHandler serves `ssh -R port:dest` like ssh.ForwardedTCPHandler,
+// which lets any connection cancel the forwards of all others. Its
+// HandleSSHRequest method can be added to the server's RequestHandlers under
+// tcpip-forward and cancel-tcpip-forward.
+type forwardedTCPHandler struct {
+	forwards map[tcpForward]net.Listener
+	sync.Mutex
+}
+
+// tcpForward identifies a forwarded port, which only the connection that
+// requested it may cancel.
+type tcpForward struct {
+	conn *gossh.ServerConn
+	addr string
+}
+
+func (h *forwardedTCPHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	h.Lock()
+	if h.forwards == nil {
+		h.forwards = make(map[tcpForward]net.Listener)
+	}
+	h.Unlock()
+	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+
+	var reqPayload remoteTCPForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+		return false, []byte{}
+	}
+
+	switch req.Type {
+	case "tcpip-forward":
+		if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort) {
+			return false, []byte("port forwarding is disabled")
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort))))
+		if err != nil {
+			log.Printf("tcpip-forward listen: %s", err)
+			return false, []byte{}
+		}
+		// keyed by the port listened on, which clients asking for port 0
+		// cancel the forward with
+		destPort := ln.Addr().(*net.TCPAddr).Port
+		key := tcpForward{conn, net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(destPort))}
+		h.Lock()
+		h.forwards[key] = ln
+		h.Unlock()
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+		}()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					break
+				}
+				origin := c.RemoteAddr().(*net.TCPAddr)
+				payload := gossh.Marshal(&remoteTCPForwardChannelData{
+					DestAddr:   reqPayload.BindAddr,
+					DestPort:   uint32(destPort),
+					OriginAddr: origin.IP.String(),
+					OriginPort: uint32(origin.Port),
+				})
+				go func() {
+					ch, reqs, err := conn.OpenChannel(forwardedTCPChannelType, payload)
+					if err != nil {
+						log.Println(err)
+						c.Close()
+						return
+					}
+					go gossh.DiscardRequests(reqs)
+					bridgeConn(ch, c)
+				}()
+			}
+			h.Lock()
+			delete(h.forwards, key)
+			h.Unlock()
+		}()
+		return true, gossh.Marshal(&remoteTCPForwardSuccess{uint32(destPort)})
+
+	case "cancel-tcpip-forward":
+		key := tcpForward{conn, net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))}
+		h.Lock()
+		ln, ok := h.forwards[key]
+		h.Unlock()
+		if !ok {
+			return false, nil
+		}
+		ln.Close()
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// forwardedStreamLocalHandler serves `ssh -R /path/to.sock:dest`. Its
+// HandleSSHRequest method can be added to the server's RequestHandlers under
+// streamlocal-forward@openssh.com and cancel-streamlocal-forward@openssh.com.
+type forwardedStreamLocalHandler struct {
+	opts     *sshdOptions
+	forwards map[streamLocalForward]net.Listener
+	sync.Mutex
+}
+
+// streamLocalForward identifies a forwarded socket, which only the
+// connection that requested it may cancel.
+type streamLocalForward struct {
+	conn       *gossh.ServerConn
+	socketPath string
+}
+
+func (h *forwardedStreamLocalHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	h.Lock()
+	if h.forwards == nil {
+		h.forwards = make(map[streamLocalForward]net.Listener)
+	}
+	h.Unlock()
+	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+
+	var reqPayload remoteStreamForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+		return false, []byte{}
+	}
+	socketPath := reqPayload.SocketPath
+	key := streamLocalForward{conn, socketPath}
+
+	switch req.Type {
+	case "streamlocal-forward@openssh.com":
+		ok := forwardAllowed(ctx, h.opts.AllowRemoteForwarding, h.opts.PermitListen, remoteKeyPermits, func(patterns []string) bool {
+			return matchSocketPath(patterns, socketPath)
+		})
+		logForward(ctx, "remote", socketPath, ok)
+		if !ok {
+			return false, []byte("streamlocal forwarding is disabled")
+		}
+		ln, err := net.Listen("unix", socketPath)
+		if err != nil {
+			log.Printf("streamlocal listen %s: %s", socketPath, err)
+			return false, []byte{}
+		}
+		h.Lock()
+		h.forwards[key] = ln
+		h.Unlock()
+		go func() {
+			<-ctx.Done()
+			ln.Close()
+		}()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					break
+				}
+				payload := gossh.Marshal(&remoteStreamForwardChannelData{SocketPath: socketPath})
+				go func() {
+					ch, reqs, err := conn.OpenChannel(forwardedStreamLocalChannelType, payload)
+					if err != nil {
+						log.Println(err)
+						c.Close()
+						return
+					}
+					go gossh.DiscardRequests(reqs)
+					bridgeConn(ch, c)
+				}()
+			}
+			// closing the listener removed the socket file
+			h.Lock()
+			delete(h.forwards, key)
+			h.Unlock()
+		}()
+		return true, nil
+
+	case "cancel-streamlocal-forward@openssh.com":
+		h.Lock()
+		ln, ok := h.forwards[key]
+		h.Unlock()
+		if !ok {
+			return false, nil
+		}
+		ln.Close()
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// bridgeConn copies data in both directions until either side is closed.
+func bridgeConn(ch gossh.Channel, c net.Conn) {
+	go func() {
+		defer ch.Close()
+		defer c.Close()
+		io.Copy(ch, c)
+	}()
+	go func() {
+		defer ch.Close()
+		defer c.Close()
+		io.Copy(c, ch)
+	}()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"log"
+	"os"
+	"path/filepath"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func defaultHostKeyPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ppobox", "ssh_host_ed25519_key")
+}
+
+// loadHostKey reads a PEM encoded ed25519 or RSA private key. When the file
+// does not exist a new ed25519 key is generated and saved there, together
+// with its public half in fileName.pub.
+func loadHostKey(fileName string) (gossh.Signer, error) {
+	pemBytes, err := os.ReadFile(fileName)
+	if err == nil {
+		return gossh.ParsePrivateKey(pemBytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	log.Printf("Generating new host key %s", fileName)
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := gossh.MarshalPrivateKey(privateKey, "ppobox easy-sshd")
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(fileName, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(fileName+".pub", gossh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
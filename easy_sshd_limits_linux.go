@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// sshdLimits caps the number of concurrent connections and sessions and
+// keeps track of the running sessions for shutdown.
+type sshdLimits struct {
+	maxConns    int
+	maxSessions int
+
+	mu       sync.Mutex
+	conns    int
+	sessions map[ssh.Session]struct{}
+	wg       sync.WaitGroup
+}
+
+func newSSHDLimits(opts *sshdOptions) *sshdLimits {
+	return &sshdLimits{
+		maxConns:    opts.MaxConnections,
+		maxSessions: opts.MaxSessions,
+		sessions:    make(map[ssh.Session]struct{}),
+	}
+}
+
+// limitedConn gives back its connection slot when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// connCallback refuses connections beyond the connection limit.
+func (l *sshdLimits) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns > 0 && l.conns >= l.maxConns {
+		log.Printf("Refusing connection from %s: %d connections open", conn.RemoteAddr(), l.conns)
+		conn.Close()
+		return nil
+	}
+	l.conns++
+	return &limitedConn{Conn: conn, release: func() {
+		l.mu.Lock()
+		l.conns--
+		l.mu.Unlock()
+	}}
+}
+
+// track wraps a session or subsystem handler so that sessions beyond the
+// session limit are refused and running sessions can be waited for.
+func (l *sshdLimits) track(next func(ssh.Session)) func(ssh.Session) {
+	return func(s ssh.Session) {
+		l.mu.Lock()
+		if l.maxSessions > 0 && len(l.sessions) >= l.maxSessions {
+			l.mu.Unlock()
+			log.Printf("Refusing session of %s@%s: %d sessions open", s.User(), s.RemoteAddr(), l.maxSessions)
+			fmt.Fprintf(s.Stderr(), "too many sessions\r\n")
+			s.Exit(1)
+			return
+		}
+		l.sessions[s] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+
+		defer func() {
+			l.mu.Lock()
+			delete(l.sessions, s)
+			l.mu.Unlock()
+			l.wg.Done()
+		}()
+		next(s)
+	}
+}
+
+// notify writes msg to the stderr of every running session. The writes do
+// not wait for each other or hold up new sessions, as a client that stopped
+// reading blocks them until its connection goes away.
+func (l *sshdLimits) notify(msg string) {
+	l.mu.Lock()
+	sessions := make([]ssh.Session, 0, len(l.sessions))
+	for s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.mu.Unlock()
+
+	for _, s := range sessions {
+		go fmt.Fprint(s.Stderr(), msg)
+	}
+}
+
+// wait waits up to timeout for the running sessions to end.
+func (l *sshdLimits) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"os"
-	"os/exec"
+	"os/signal"
 	"syscall"
+	"time"
 	"unsafe"
 
-	"github.com/creack/pty"
 	"github.com/gliderlabs/ssh"
-	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 func setWinsize(f *os.File, w, h int) {
@@ -20,82 +21,252 @@ func setWinsize(f *os.File, w, h int) {
 		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
 }
 
-// SftpHandler handler for SFTP subsystem
-func SftpHandler(sess ssh.Session) {
-	debugStream := io.Discard
-	serverOptions := []sftp.ServerOption{
-		sftp.WithDebug(debugStream),
-	}
-	server, err := sftp.NewServer(
-		sess,
-		serverOptions...,
-	)
+// sshdContextKey is the type of the values easy-sshd stores in an ssh.Context.
+type sshdContextKey struct {
+	name string
+}
+
+func startSSHD(opts *sshdOptions) {
+	if opts.Scrollback < 0 {
+		log.Fatal("-scrollback must not be negative")
+	}
+	creds, err := loadSSHDCredentials(opts)
 	if err != nil {
-		log.Printf("sftp server init error: %s\n", err)
-		return
+		log.Fatal(err)
 	}
-	if err := server.Serve(); err == io.EOF {
-		server.Close()
-		fmt.Println("sftp client exited session.")
-	} else if err != nil {
-		fmt.Println("sftp server completed with error:", err)
+	creds.log()
+	store := newCredentialStore(opts, creds)
+	go store.reloadOnSignal()
+	if opts.ReloadInterval > 0 {
+		go store.watch(opts.ReloadInterval)
 	}
-}
 
-func startSSHD(host, port, user, password, command string) {
-	ssh.Handle(func(s ssh.Session) {
-		cmd := exec.Command("sh", "-c", command)
-		ptyReq, winCh, isPty := s.Pty()
-		if isPty {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
-			f, err := pty.Start(cmd)
-			if err != nil {
-				panic(err)
-			}
-			go func() {
-				for win := range winCh {
-					setWinsize(f, win.Width, win.Height)
-				}
-			}()
-			go func() {
-				io.Copy(f, s) // stdin
-			}()
-			io.Copy(s, f) // stdout
-			cmd.Wait()
-		} else {
-			io.WriteString(s, "No PTY requested.\n")
-			s.Exit(1)
+	var auditor *auditLog
+	if opts.AuditLog != "" {
+		if auditor, err = openAuditLog(opts.AuditLog); err != nil {
+			log.Fatal(err)
 		}
-	})
+	}
+	var admin *sshdAdmin
+	if opts.AdminListen != "" {
+		admin = newSSHDAdmin()
+		if err := admin.serve(opts.AdminListen, opts.AdminTokenFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	throttle := newAuthThrottle(opts)
+	limits := newSSHDLimits(opts)
+	session := sessionHandler(opts)
+	subsystems, err := subsystemHandlers(opts, session)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, handler := range subsystems {
+		subsystems[name] = admin.track(limits.track(handler))
+	}
+	forwardHandler := &forwardedTCPHandler{}
+	streamLocalHandler := &forwardedStreamLocalHandler{opts: opts}
 
-	log.Printf("Starting ssh server on %s:%s", host, port)
 	sshServer := ssh.Server{
-		Addr: host + ":" + port,
-		SubsystemHandlers: map[string]ssh.SubsystemHandler{
-			"sftp": SftpHandler,
+		Handler:           admin.track(limits.track(session)),
+		IdleTimeout:       opts.IdleTimeout,
+		MaxTimeout:        opts.MaxTimeout,
+		SubsystemHandlers: subsystems,
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session":                        sessionChannelHandler,
+			"direct-tcpip":                   ssh.DirectTCPIPHandler,
+			"direct-streamlocal@openssh.com": directStreamLocalHandler(opts),
+		},
+		RequestHandlers: map[string]ssh.RequestHandler{
+			"tcpip-forward":                          forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward":                   forwardHandler.HandleSSHRequest,
+			"streamlocal-forward@openssh.com":        streamLocalHandler.HandleSSHRequest,
+			"cancel-streamlocal-forward@openssh.com": streamLocalHandler.HandleSSHRequest,
 		},
-		PasswordHandler: func(ctx ssh.Context, pass string) bool {
-			return ctx.User() == user && pass == password
+		LocalPortForwardingCallback:   localForwardingCallback(opts),
+		ReversePortForwardingCallback: reverseForwardingCallback(opts),
+		ConnCallback: func(ctx ssh.Context, conn net.Conn) net.Conn {
+			if conn = throttle.connCallback(ctx, conn); conn == nil {
+				return nil
+			}
+			if conn = limits.connCallback(ctx, conn); conn == nil {
+				return nil
+			}
+			conn = admin.connCallback(ctx, conn)
+			if auditor == nil {
+				return conn
+			}
+			return auditor.connCallback(ctx, conn)
 		},
+		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
+			creds := store.load()
+			ctx.SetValue(contextKeyCredentials, creds)
+			publicKeyCheck := auditPublicKeyHandler(publicKeyHandler(creds.users, creds.certs, creds.revoked))
+			var passwordCheck ssh.PasswordHandler
+			if creds.hasPassword() {
+				passwordCheck = throttle.passwordHandler(passwordHandler(creds.users))
+			}
+			config := &gossh.ServerConfig{
+				MaxAuthTries: opts.MaxAuthTries,
+				AuthLogCallback: func(conn gossh.ConnMetadata, method string, err error) {
+					authLogCallback(conn, method, err)
+					auditAuth(ctx, conn, method, err)
+					admin.authLog(ctx, method, err)
+				},
+			}
+			setAuthCallbacks(ctx, config, throttle, passwordCheck, publicKeyCheck)
+			return config
+		},
+		PtyCallback: func(ctx ssh.Context, pty ssh.Pty) bool {
+			ak := sessionAuthorizedKey(ctx)
+			return ak == nil || !ak.NoPty
+		},
+	}
+	for name, handler := range sshServer.ChannelHandlers {
+		sshServer.ChannelHandlers[name] = afterAuthChannel(handler)
 	}
-	log.Fatal(sshServer.ListenAndServe())
+	for name, handler := range sshServer.RequestHandlers {
+		sshServer.RequestHandlers[name] = afterAuthRequest(handler)
+	}
+	var hostKey gossh.Signer
+	if opts.HostKey != "" {
+		if hostKey, err = loadHostKey(opts.HostKey); err != nil {
+			log.Fatal(err)
+		}
+		sshServer.AddHostKey(hostKey)
+		log.Printf("Host key %s %s", hostKey.PublicKey().Type(), gossh.FingerprintSHA256(hostKey.PublicKey()))
+	}
+	stopped := make(chan struct{})
+	if opts.ShutdownTimeout > 0 {
+		go func() {
+			shutdownOnSignal(&sshServer, limits, opts.ShutdownTimeout)
+			close(stopped)
+		}()
+	}
+	listen := opts.Listen
+	if len(listen) == 0 && opts.Relay == "" {
+		listen = listFlag{net.JoinHostPort(opts.Host, opts.Port)}
+	}
+	var proxies *trustedProxies
+	if opts.ProxyProtocol {
+		if proxies, err = parseTrustedProxies(opts.ProxyFrom); err != nil {
+			log.Fatalf("-proxy-from: %s", err)
+		}
+	}
+	var listeners []net.Listener
+	for _, addr := range listen {
+		l, err := listenAddress(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.ProxyProtocol {
+			l = &proxyListener{l, proxies}
+		}
+		log.Printf("Starting ssh server on %s", addr)
+		listeners = append(listeners, l)
+	}
+	if opts.Relay != "" {
+		relay, err := newRelayListener(opts, hostKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Starting ssh server on %s through relay %s", opts.RelayForward, opts.Relay)
+		listeners = append(listeners, relay)
+	}
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			served <- sshServer.Serve(l)
+		}(l)
+	}
+	for range listeners {
+		if err := <-served; err != ssh.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-stopped
+	log.Printf("easy-sshd stopped")
 }
 
-func easySSHD() {
+// shutdownOnSignal stops accepting connections on SIGTERM or SIGINT, tells
+// the clients and waits up to timeout for their sessions to end before
+// closing the remaining connections.
+func shutdownOnSignal(sshServer *ssh.Server, limits *sshdLimits, timeout time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	log.Printf("Received %s, shutting down within %s", sig, timeout)
+	limits.notify(fmt.Sprintf("\r\neasy-sshd is shutting down, the session will be closed within %s\r\n", timeout))
 
-	var port string
-	var host string
-	var user string
-	var password string
-	var command string
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		// a second signal ends the waiting
+		<-sigCh
+		cancel()
+	}()
+	if err := sshServer.Shutdown(ctx); err != nil {
+		log.Printf("Closing the remaining connections: %s", err)
+		sshServer.Close()
+		if !limits.wait(5 * time.Second) {
+			log.Printf("Sessions did not end in time")
+		}
+	}
+}
+
+func easySSHD() {
+	opts := &sshdOptions{}
 
 	newFlag := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
 
-	newFlag.StringVar(&port, "port", "2222", "Port to listen on")
-	newFlag.StringVar(&host, "host", "0.0.0.0", "Host to listen on")
-	newFlag.StringVar(&user, "user", "root", "User to login")
-	newFlag.StringVar(&password, "password", "root", "Password to login")
-	newFlag.StringVar(&command, "command", "/bin/bash --login", "Command to execute for shell")
+	newFlag.StringVar(&opts.Port, "port", "2222", "Port to listen on")
+	newFlag.StringVar(&opts.Host, "host", "0.0.0.0", "Host to listen on")
+	newFlag.Var(&opts.Listen, "listen", "Address to listen on as host:port, [ipv6]:port or unix:/path, may be repeated, overrides -host and -port")
+	newFlag.BoolVar(&opts.ProxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header from a load balancer on every -listen connection")
+	newFlag.Var(&opts.ProxyFrom, "proxy-from", "Comma separated addresses or CIDRs of the load balancers trusted to send PROXY headers, unix for Unix socket clients, required with -proxy-protocol")
+	newFlag.StringVar(&opts.User, "user", "root", "User to login")
+	newFlag.StringVar(&opts.Password, "password", "root", "Password to login, empty to disable password login")
+	newFlag.StringVar(&opts.PasswordFile, "password-file", "", "File holding the password to login, overrides -password and is re-read on reload")
+	newFlag.StringVar(&opts.TOTPSecret, "totp-secret", "", "Base32 TOTP secret, asks for a verification code after password or key login (see easy-sshd-totp-setup)")
+	newFlag.StringVar(&opts.Command, "command", "/bin/bash --login", "Command to execute for shell")
+	newFlag.StringVar(&opts.HostKey, "hostkey", defaultHostKeyPath(), "Host private key file, generated on first run")
+	newFlag.StringVar(&opts.AuthorizedKeys, "authorized-keys", defaultAuthorizedKeysPath(), "OpenSSH authorized_keys file for public key login")
+	newFlag.StringVar(&opts.UserCAKeys, "trusted-user-ca-keys", "", "File of CA public keys trusted to sign user certificates")
+	newFlag.StringVar(&opts.RevokedKeys, "revoked-keys", "", "Key revocation list (ssh-keygen -k) or file of revoked public keys")
+	newFlag.StringVar(&opts.Config, "config", "", "JSON file listing the users, overrides -user, -password and -authorized-keys")
+	newFlag.DurationVar(&opts.ReloadInterval, "reload-interval", 0, "Check the credential files this often and reload them when changed, 0 to only reload on SIGHUP")
+	newFlag.StringVar(&opts.SftpRoot, "sftp-root", "", "Directory SFTP is confined to, the whole file system if empty")
+	newFlag.BoolVar(&opts.SftpReadOnly, "sftp-readonly", false, "Refuse all SFTP operations that modify files")
+	newFlag.StringVar(&opts.AcceptEnv, "accept-env", "LANG,LC_*", "Comma separated client environment variables to accept, * as wildcard")
+	newFlag.IntVar(&opts.MaxAuthTries, "max-auth-tries", 6, "Authentication attempts allowed per connection")
+	newFlag.DurationVar(&opts.AuthDelay, "auth-delay", time.Second, "Delay after a failed password, doubled for every further failure from the same address")
+	newFlag.DurationVar(&opts.AuthMaxDelay, "auth-max-delay", 30*time.Second, "Upper limit of the delay after a failed password")
+	newFlag.IntVar(&opts.BanAfter, "ban-after", 10, "Failed passwords after which an address is banned, 0 to never ban")
+	newFlag.DurationVar(&opts.BanTime, "ban-time", 15*time.Minute, "How long an address stays banned, failures older than this are forgotten")
+	newFlag.DurationVar(&opts.IdleTimeout, "idle-timeout", 0, "Close connections without traffic for this long, 0 for no limit")
+	newFlag.DurationVar(&opts.MaxTimeout, "max-timeout", 0, "Close connections after this long regardless of activity, 0 for no limit")
+	newFlag.IntVar(&opts.MaxConnections, "max-connections", 0, "Maximum number of concurrent connections, 0 for no limit")
+	newFlag.IntVar(&opts.MaxSessions, "max-sessions", 0, "Maximum number of concurrent sessions, 0 for no limit")
+	newFlag.DurationVar(&opts.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Time sessions get to end after SIGTERM or SIGINT, 0 to exit immediately")
+	newFlag.StringVar(&opts.AuditLog, "audit-log", "", "File to append a JSON line to for every login, command, forward and SFTP operation")
+	newFlag.IntVar(&opts.Scrollback, "scrollback", 64*1024, "Bytes of output kept for clients attaching to a named session (ssh -t host attach NAME)")
+	newFlag.Var(&opts.Subsystems, "subsystem", "Subsystem as name=command, or name=builtin:sftp or name=builtin:file-summary, may be repeated")
+	newFlag.StringVar(&opts.AdminListen, "admin-listen", "", "Loopback host:port or unix:/path to serve the admin API on, listing and terminating sessions")
+	newFlag.StringVar(&opts.AdminTokenFile, "admin-token-file", "", "File holding the bearer token the admin API requires on a host:port -admin-listen")
+	newFlag.StringVar(&opts.RecordDir, "record-dir", "", "Directory to record interactive sessions to in asciicast v2 format")
+	newFlag.BoolVar(&opts.AllowLocalForwarding, "allow-local-forwarding", false, "Allow local port forwarding (ssh -L)")
+	newFlag.BoolVar(&opts.AllowRemoteForwarding, "allow-remote-forwarding", false, "Allow remote port forwarding (ssh -R)")
+	newFlag.BoolVar(&opts.AllowAgentForwarding, "allow-agent-forwarding", true, "Allow ssh-agent forwarding (ssh -A)")
+	newFlag.Var(&opts.PermitOpen, "permit-open", "Comma separated host:port destinations or socket paths allowed for local forwarding, * as wildcard")
+	newFlag.Var(&opts.PermitListen, "permit-listen", "Comma separated host:port bind addresses or socket paths allowed for remote forwarding, * as wildcard")
+	newFlag.StringVar(&opts.Relay, "relay", "", "host[:port] of an SSH server to dial out to and serve through a remote forward, instead of listening")
+	newFlag.StringVar(&opts.RelayUser, "relay-user", "", "User to log in to the relay as")
+	newFlag.StringVar(&opts.RelayIdentity, "relay-identity", "", "Private key file to log in to the relay with, the host key if empty")
+	newFlag.StringVar(&opts.RelayPassword, "relay-password", "", "Password to log in to the relay with, requires -relay-known-hosts")
+	newFlag.StringVar(&opts.RelayKnownHosts, "relay-known-hosts", "", "known_hosts file to verify the relay's host key with, not verified if empty and no -relay-password is given")
+	newFlag.StringVar(&opts.RelayForward, "relay-forward", "127.0.0.1:2222", "Address the relay listens on for connections to this server (ssh -R bind address)")
+	newFlag.DurationVar(&opts.RelayKeepAlive, "relay-keepalive", 30*time.Second, "Interval of keepalives to the relay, the link is dropped when one goes unanswered, 0 to disable")
+	newFlag.DurationVar(&opts.RelayMaxBackoff, "relay-max-backoff", time.Minute, "Upper limit of the wait between attempts to reconnect to the relay")
 
 	log.Println("Starting easy-sshd args : ", os.Args[1:])
 	err := newFlag.Parse(os.Args[2:])
@@ -103,5 +274,5 @@ func easySSHD() {
 		log.Fatal(err)
 	}
 
-	startSSHD(host, port, user, password, command)
+	startSSHD(opts)
 }
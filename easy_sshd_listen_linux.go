@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listenAddress listens on addr, a host:port with IPv6 hosts in brackets,
+// or unix:/path for a Unix socket. A socket file left behind by an earlier
+// run is replaced, one that is still served is an error.
+func listenAddress(addr string) (net.Listener, error) {
+	if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", socket); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("listen address %s: socket is in use", addr)
+			}
+			os.Remove(socket)
+		}
+		return net.Listen("unix", socket)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("listen address %s: %w", addr, err)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// proxyHeaderTimeout is how long a client behind a proxy gets to send the
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections that start with a PROXY protocol v1 or
+// v2 header, as sent by load balancers such as HAProxy, and reports the
+// client address from the header as their remote address. Connections from
+// peers other than the trusted proxies are closed, as anyone could claim
+// any client address in a header.
+type proxyListener struct {
+	net.Listener
+	trusted *trustedProxies
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.trusted.contains(conn.RemoteAddr()) {
+			log.Printf("Closing connection from %s: not a trusted proxy", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+	}
+}
+
+// trustedProxies are the peers allowed to send PROXY headers, as given by
+// -proxy-from.
+type trustedProxies struct {
+	nets []*net.IPNet
+	unix bool
+}
+
+// parseTrustedProxies parses addresses and CIDRs, and "unix" for the
+// clients of Unix socket listeners.
+func parseTrustedProxies(list []string) (*trustedProxies, error) {
+	t := &trustedProxies{}
+	for _, s := range list {
+		if s == "unix" {
+			t.unix = true
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR", s)
+		}
+		t.nets = append(t.nets, ipNet)
+	}
+	if len(t.nets) == 0 && !t.unix {
+		return nil, fmt.Errorf("no trusted proxies")
+	}
+	return t, nil
+}
+
+func (t *trustedProxies) contains(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		for _, ipNet := range t.nets {
+			if ipNet.Contains(addr.IP) {
+				return true
+			}
+		}
+		return false
+	case *net.UnixAddr:
+		return t.unix
+	default:
+		return false
+	}
+}
+
+// proxyConn reads the PROXY header on first use, in the goroutine serving
+// the connection rather than in the accept loop.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("Closing connection from %s: PROXY header: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header and returns the client
+// address it carries, or nil for a connection of the proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1Header(r)
+	}
+	return nil, fmt.Errorf("missing")
+}
+
+// readProxyV1Header reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2
+// 56324 22\r\n".
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a binary header.
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command := header[12] & 0xf; command {
+	case 0: // LOCAL, e.g. a health check of the proxy
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+	switch family := header[13]; family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short v2 IPv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short v2 IPv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// UNSPEC, UDP and Unix sockets carry no TCP client address
+		return nil, nil
+	}
+}
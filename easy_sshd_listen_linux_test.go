@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The examples of the PROXY protocol specification, followed by the start
+// of the SSH stream.
+func TestReadProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name   string
+		header string
+		remote string // "" for none
+		err    bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\n", "192.0.2.1:56324", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n", "[2001:db8::1]:56324", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", false},
+		{"v1 bad address", "PROXY TCP4 192.0.2.x 192.0.2.2 56324 22\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 22\r\n", "", true},
+		{"v1 too few fields", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat(" ", 100) + "\r\n", "", true},
+		{"v2 TCP4", v2 + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc0\x00\x02\x02" + "\xdc\x04\x00\x16", "192.0.2.1:56324", false},
+		{"v2 TCP6", v2 + "\x21\x21\x00\x24" + "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01" + "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x02" + "\xdc\x04\x00\x16", "[2001:db8::1]:56324", false},
+		{"v2 TLVs after address", v2 + "\x21\x11\x00\x10" + "\xc0\x00\x02\x01" + "\xc0\x00\x02\x02" + "\xdc\x04\x00\x16" + "\x04\x00\x01\x00", "192.0.2.1:56324", false},
+		{"v2 LOCAL", v2 + "\x20\x00\x00\x00", "", false},
+		{"v2 UNSPEC", v2 + "\x21\x00\x00\x00", "", false},
+		{"v2 Unix socket", v2 + "\x21\x31\x00\x00", "", false},
+		{"v2 bad version", v2 + "\x11\x11\x00\x0c" + strings.Repeat("\x00", 12), "", true},
+		{"v2 bad command", v2 + "\x22\x11\x00\x0c" + strings.Repeat("\x00", 12), "", true},
+		{"v2 short address", v2 + "\x21\x11\x00\x04" + "\xc0\x00\x02\x01", "", true},
+		{"v2 truncated", v2 + "\x21\x11\x00\x40" + "\xc0\x00", "", true},
+		{"missing", "SSH-2.0-OpenSSH_9.6\r\n", "", true},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.header + "SSH-2.0-client\r\n"))
+		remote, err := readProxyHeader(r)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := addrString(remote); got != tt.remote {
+			t.Errorf("%s: remote %q, want %q", tt.name, got, tt.remote)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "SSH-2.0-client\r\n" {
+			t.Errorf("%s: stream continues with %q", tt.name, rest)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"192.0.2.1", "198.51.100.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr    net.Addr
+		trusted bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}, false},
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.200"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db9::1"), Port: 1234}, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := trusted.contains(tt.addr); got != tt.trusted {
+			t.Errorf("contains(%s) = %v, want %v", tt.addr, got, tt.trusted)
+		}
+	}
+
+	unix, err := parseTrustedProxies([]string{"unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unix.contains(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Error("unix: Unix socket client not trusted")
+	}
+
+	for _, list := range [][]string{nil, {"proxy.example.com"}, {"192.0.2.0/33"}} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q): no error", list)
+		}
+	}
+}
+
+func TestListenAddressSocket(t *testing.T) {
+	addr := "unix:" + filepath.Join(t.TempDir(), "sock")
+	l, err := listenAddress(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAddress(addr); err == nil {
+		t.Error("socket in use replaced")
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenAddress(addr)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %s", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sshdOptions holds the settings easy-sshd is started with.
+type sshdOptions struct {
+	Host           string
+	Port           string
+	Listen         listFlag
+	ProxyProtocol  bool
+	ProxyFrom      listFlag
+	User           string
+	Password       string
+	PasswordFile   string
+	TOTPSecret     string
+	Command        string
+	HostKey        string
+	AuthorizedKeys string
+	UserCAKeys     string
+	RevokedKeys    string
+	Config         string
+	ReloadInterval time.Duration
+	SftpRoot       string
+	SftpReadOnly   bool
+	Scrollback     int
+	RecordDir      string
+	AcceptEnv      string
+	AuditLog       string
+	AdminListen    string
+	AdminTokenFile string
+	Subsystems     subsystemFlag
+
+	MaxAuthTries int
+	AuthDelay    time.Duration
+	AuthMaxDelay time.Duration
+	BanAfter     int
+	BanTime      time.Duration
+
+	IdleTimeout     time.Duration
+	MaxTimeout      time.Duration
+	MaxConnections  int
+	MaxSessions     int
+	ShutdownTimeout time.Duration
+
+	AllowLocalForwarding  bool
+	AllowRemoteForwarding bool
+	AllowAgentForwarding  bool
+	PermitOpen            listFlag
+	PermitListen          listFlag
+
+	Relay           string
+	RelayUser       string
+	RelayIdentity   string
+	RelayPassword   string
+	RelayKnownHosts string
+	RelayForward    string
+	RelayKeepAlive  time.Duration
+	RelayMaxBackoff time.Duration
+}
+
+// listFlag is a flag.Value collecting comma separated values. The flag may
+// be given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// sshdSubsystem is a subsystem of the -config file or a -subsystem flag. It
+// either runs an external command with its stdin and stdout connected to
+// the channel, or one of the builtinSubsystems.
+type sshdSubsystem struct {
+	Command string `json:"command"`
+	Builtin string `json:"builtin"`
+}
+
+// subsystemFlag is a flag.Value collecting name=command pairs, and
+// name=builtin:handler for the builtin handlers. The flag may be given more
+// than once.
+type subsystemFlag map[string]*sshdSubsystem
+
+func (f *subsystemFlag) String() string {
+	var pairs []string
+	for name, sub := range *f {
+		if sub.Builtin != "" {
+			pairs = append(pairs, name+"=builtin:"+sub.Builtin)
+		} else {
+			pairs = append(pairs, name+"="+sub.Command)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (f *subsystemFlag) Set(value string) error {
+	name, command, ok := strings.Cut(value, "=")
+	if !ok || name == "" || command == "" {
+		return fmt.Errorf("want name=command or name=builtin:handler")
+	}
+	if *f == nil {
+		*f = make(subsystemFlag)
+	}
+	if builtin, ok := strings.CutPrefix(command, "builtin:"); ok {
+		(*f)[name] = &sshdSubsystem{Builtin: builtin}
+	} else {
+		(*f)[name] = &sshdSubsystem{Command: command}
+	}
+	return nil
+}
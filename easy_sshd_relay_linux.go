@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// relayInitialBackoff is the first wait before reconnecting to the relay.
+const relayInitialBackoff = time.Second
+
+// relayListener accepts the connections of a remote forward requested from
+// a relay SSH server, so that easy-sshd can be reached through the relay
+// when it cannot accept connections itself. It keeps the link up, and
+// reconnects with exponential backoff when it drops.
+type relayListener struct {
+	addr       string
+	forward    string
+	config     *gossh.ClientConfig
+	keepAlive  time.Duration
+	maxBackoff time.Duration
+
+	backoff   time.Duration
+	connected time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu     sync.Mutex
+	client *gossh.Client
+	ln     net.Listener
+}
+
+// relayAddr is the address a relayListener listens on.
+type relayAddr string
+
+func (a relayAddr) Network() string { return "ssh-relay" }
+func (a relayAddr) String() string  { return string(a) }
+
+func newRelayListener(opts *sshdOptions, hostKey gossh.Signer) (*relayListener, error) {
+	if opts.RelayUser == "" {
+		return nil, fmt.Errorf("-relay needs -relay-user")
+	}
+	var auth []gossh.AuthMethod
+	signer := hostKey
+	if opts.RelayIdentity != "" {
+		pemBytes, err := os.ReadFile(opts.RelayIdentity)
+		if err != nil {
+			return nil, err
+		}
+		if signer, err = gossh.ParsePrivateKey(pemBytes); err != nil {
+			return nil, fmt.Errorf("%s: %w", opts.RelayIdentity, err)
+		}
+	}
+	if signer != nil {
+		auth = append(auth, gossh.PublicKeys(signer))
+	}
+	if opts.RelayPassword != "" {
+		auth = append(auth, gossh.Password(opts.RelayPassword))
+	}
+
+	if opts.RelayPassword != "" && opts.RelayKnownHosts == "" {
+		// the password would go to whoever answers
+		return nil, fmt.Errorf("-relay-password needs -relay-known-hosts")
+	}
+	hostKeyCallback := gossh.InsecureIgnoreHostKey()
+	if opts.RelayKnownHosts != "" {
+		var err error
+		if hostKeyCallback, err = knownhosts.New(opts.RelayKnownHosts); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("Not verifying the host key of relay %s, use -relay-known-hosts", opts.Relay)
+	}
+
+	addr := opts.Relay
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return &relayListener{
+		addr:    addr,
+		forward: opts.RelayForward,
+		config: &gossh.ClientConfig{
+			User:            opts.RelayUser,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+		keepAlive:  opts.RelayKeepAlive,
+		maxBackoff: opts.RelayMaxBackoff,
+		backoff:    relayInitialBackoff,
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+// connect logs in to the relay and requests the remote forward.
+func (l *relayListener) connect() (net.Listener, error) {
+	client, err := gossh.Dial("tcp", l.addr, l.config)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := client.Listen("tcp", l.forward)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("remote forward %s: %w", l.forward, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+		client.Close()
+		return nil, net.ErrClosed
+	default:
+	}
+	l.client, l.ln = client, ln
+	l.connected = time.Now()
+	if l.keepAlive > 0 {
+		go l.keepAliveLoop(client)
+	}
+	log.Printf("Serving on %s through relay %s", l.forward, l.addr)
+	return ln, nil
+}
+
+// keepAliveLoop closes client when the relay stops answering, which ends
+// the Accept of its listener.
+func (l *relayListener) keepAliveLoop(client *gossh.Client) {
+	ticker := time.NewTicker(l.keepAlive)
+	defer ticker.Stop()
+	for range ticker.C {
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+		case <-time.After(l.keepAlive):
+			log.Printf("Relay %s not answering", l.addr)
+			client.Close()
+			return
+		}
+	}
+}
+
+// sleep waits for d and reports false when the listener was closed
+// meanwhile.
+func (l *relayListener) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+// retryLater waits before the next connection attempt.
+func (l *relayListener) retryLater() bool {
+	d := l.backoff
+	if l.backoff *= 2; l.backoff > l.maxBackoff {
+		l.backoff = l.maxBackoff
+	}
+	return l.sleep(d)
+}
+
+func (l *relayListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		ln := l.ln
+		l.mu.Unlock()
+
+		if ln == nil {
+			var err error
+			if ln, err = l.connect(); err != nil {
+				if err == net.ErrClosed {
+					return nil, err
+				}
+				log.Printf("Relay %s: %s, retrying in %s", l.addr, err, l.backoff)
+				if !l.retryLater() {
+					return nil, net.ErrClosed
+				}
+				continue
+			}
+		}
+
+		conn, err := ln.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-l.closed:
+			return nil, net.ErrClosed
+		default:
+		}
+		log.Printf("Relay link to %s lost: %v", l.addr, err)
+		l.mu.Lock()
+		l.client.Close()
+		l.client, l.ln = nil, nil
+		l.mu.Unlock()
+
+		// reconnect at once after a link that was up for a while, and
+		// back off when links keep dropping right after being set up
+		if time.Since(l.connected) > l.maxBackoff {
+			l.backoff = relayInitialBackoff
+		} else if !l.retryLater() {
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// Close cancels the remote forward. The link to the relay stays up for the
+// connections already accepted over it.
+func (l *relayListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln != nil {
+		return l.ln.Close()
+	}
+	return nil
+}
+
+func (l *relayListener) Addr() net.Addr {
+	return relayAddr(l.forward + " via " + l.addr)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sshdCredentials are the users, keys and CAs easy-sshd authenticates
+// against. A reload replaces them as a whole; connections keep the ones
+// they were accepted with.
+type sshdCredentials struct {
+	users      map[string]*sshdUser
+	cas        []gossh.PublicKey
+	certs      *userCertChecker
+	revoked    *keyRevocationList
+	revokedSum [sha256.Size]byte
+}
+
+var contextKeyCredentials = &sshdContextKey{"credentials"}
+
+// loadSSHDCredentials reads the users, the revocation list and the trusted
+// user CAs.
+func loadSSHDCredentials(opts *sshdOptions) (*sshdCredentials, error) {
+	users, err := loadSSHDUsers(opts)
+	if err != nil {
+		return nil, err
+	}
+	creds := &sshdCredentials{users: users}
+	if opts.RevokedKeys != "" {
+		data, err := os.ReadFile(opts.RevokedKeys)
+		if err != nil {
+			return nil, err
+		}
+		creds.revokedSum = sha256.Sum256(data)
+		if creds.revoked, err = loadRevokedKeys(opts.RevokedKeys); err != nil {
+			return nil, err
+		}
+	}
+	if opts.UserCAKeys != "" {
+		if creds.cas, err = loadTrustedUserCAKeys(opts.UserCAKeys); err != nil {
+			return nil, err
+		}
+		creds.certs = &userCertChecker{cas: creds.cas, revoked: creds.revoked}
+	}
+	return creds, nil
+}
+
+func (c *sshdCredentials) hasPassword() bool {
+	for _, u := range c.users {
+		if u.hasPassword() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *sshdCredentials) log() {
+	for _, u := range c.users {
+		log.Printf("User %s: %d authorized keys, password login %v, TOTP %v", u.Name, len(u.keys), u.hasPassword(), u.TOTPSecret != "")
+	}
+	for _, ca := range c.cas {
+		log.Printf("Trusting user CA %s %s", ca.Type(), gossh.FingerprintSHA256(ca))
+	}
+}
+
+// connCredentials returns the credentials a connection authenticates
+// against.
+func connCredentials(ctx ssh.Context) *sshdCredentials {
+	creds, _ := ctx.Value(contextKeyCredentials).(*sshdCredentials)
+	return creds
+}
+
+// changes describes how c differs from old.
+func (c *sshdCredentials) changes(old *sshdCredentials) []string {
+	var changes []string
+	for _, name := range sortedUserNames(old.users) {
+		if c.users[name] == nil {
+			changes = append(changes, fmt.Sprintf("user %s removed", name))
+		}
+	}
+	for _, name := range sortedUserNames(c.users) {
+		u, prev := c.users[name], old.users[name]
+		if prev == nil {
+			changes = append(changes, fmt.Sprintf("user %s added", name))
+			continue
+		}
+		var what []string
+		if u.PasswordHash != prev.PasswordHash || u.password != prev.password {
+			what = append(what, "password changed")
+		}
+		added, removed := diffKeys(keysOf(u.keys), keysOf(prev.keys))
+		if added > 0 || removed > 0 {
+			what = append(what, fmt.Sprintf("%d authorized keys added, %d removed", added, removed))
+		}
+		if u.TOTPSecret != prev.TOTPSecret {
+			what = append(what, "TOTP secret changed")
+		}
+		if u.Command != prev.Command || u.Home != prev.Home || u.SftpRoot != prev.SftpRoot || !reflect.DeepEqual(u.Env, prev.Env) {
+			what = append(what, "settings changed")
+		}
+		if len(what) > 0 {
+			changes = append(changes, fmt.Sprintf("user %s: %s", name, strings.Join(what, ", ")))
+		}
+	}
+	if added, removed := diffKeys(c.cas, old.cas); added > 0 || removed > 0 {
+		changes = append(changes, fmt.Sprintf("%d user CAs added, %d removed", added, removed))
+	}
+	if c.revokedSum != old.revokedSum {
+		changes = append(changes, "revoked keys changed")
+	}
+	return changes
+}
+
+func sortedUserNames(users map[string]*sshdUser) []string {
+	var names []string
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func keysOf(keys []*authorizedKey) []gossh.PublicKey {
+	var resp []gossh.PublicKey
+	for _, ak := range keys {
+		resp = append(resp, ak.Key)
+	}
+	return resp
+}
+
+// diffKeys counts the keys only in keys and those only in old.
+func diffKeys(keys, old []gossh.PublicKey) (added, removed int) {
+	set := make(map[string]int)
+	for _, k := range keys {
+		set[string(k.Marshal())]++
+	}
+	for _, k := range old {
+		set[string(k.Marshal())]--
+	}
+	for _, n := range set {
+		if n > 0 {
+			added += n
+		} else {
+			removed -= n
+		}
+	}
+	return added, removed
+}
+
+// credentialStore holds the current credentials and reloads them on
+// SIGHUP and, with -reload-interval, when their files change.
+type credentialStore struct {
+	opts    *sshdOptions
+	current atomic.Pointer[sshdCredentials]
+
+	mu    sync.Mutex // serializes reloads
+	stamp string
+}
+
+func newCredentialStore(opts *sshdOptions, creds *sshdCredentials) *credentialStore {
+	s := &credentialStore{opts: opts}
+	s.current.Store(creds)
+	s.stamp = s.filesStamp()
+	return s
+}
+
+func (s *credentialStore) load() *sshdCredentials {
+	return s.current.Load()
+}
+
+// reload replaces the credentials when all of them load, and keeps the
+// current ones otherwise.
+func (s *credentialStore) reload(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		s.stamp = s.filesStamp()
+	}()
+
+	creds, err := loadSSHDCredentials(s.opts)
+	if err != nil {
+		log.Printf("Reload on %s rejected, keeping the current credentials: %s", reason, err)
+		return
+	}
+	old := s.load()
+	for name, u := range creds.users {
+		if prev := old.users[name]; prev != nil && prev.TOTPSecret == u.TOTPSecret {
+			// codes used before the reload stay used
+			u.totp = prev.totp
+		}
+	}
+	s.current.Store(creds)
+
+	changes := creds.changes(old)
+	if len(changes) == 0 {
+		log.Printf("Reloaded credentials on %s: no changes", reason)
+		return
+	}
+	for _, change := range changes {
+		log.Printf("Reloaded credentials on %s: %s", reason, change)
+	}
+}
+
+// reloadOnSignal reloads the credentials on every SIGHUP.
+func (s *credentialStore) reloadOnSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		s.reload("SIGHUP")
+	}
+}
+
+// watch reloads the credentials when one of their files changes, checking
+// every interval.
+func (s *credentialStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mu.Lock()
+		changed := s.filesStamp() != s.stamp
+		s.mu.Unlock()
+		if changed {
+			s.reload("file change")
+		}
+	}
+}
+
+// filesStamp returns the size and modification time of the files the
+// credentials are read from.
+func (s *credentialStore) filesStamp() string {
+	files := []string{s.opts.Config, s.opts.PasswordFile, s.opts.UserCAKeys, s.opts.RevokedKeys}
+	if creds := s.load(); creds != nil {
+		for _, name := range sortedUserNames(creds.users) {
+			files = append(files, creds.users[name].AuthorizedKeysFile)
+		}
+	}
+	var stamp strings.Builder
+	for _, name := range files {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&stamp, "%s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(&stamp, "%s missing\n", name)
+		}
+	}
+	return stamp.String()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// keyRevocationList holds revoked keys and certificates, read from either
+// an OpenSSH key revocation list (ssh-keygen -k) or a plain file listing
+// public keys one per line.
+type keyRevocationList struct {
+	keys   map[string]bool // marshaled public keys
+	sha1   map[string]bool
+	sha256 map[string]bool
+	certs  []*krlCertSection
+}
+
+// krlCertSection revokes certificates of one CA, or of any CA when ca is
+// empty, by serial number or key id.
+type krlCertSection struct {
+	ca      []byte
+	serials map[uint64]bool
+	ranges  [][2]uint64
+	keyIDs  map[string]bool
+}
+
+const krlMagic = "SSHKRL\n\x00"
+
+// KRL section types, see PROTOCOL.krl in the OpenSSH sources.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+func newKeyRevocationList() *keyRevocationList {
+	return &keyRevocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+}
+
+// loadRevokedKeys reads a revocation list. A missing file is an error, as
+// silently accepting revoked keys is worse than not starting.
+func loadRevokedKeys(fileName string) (*keyRevocationList, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	l := newKeyRevocationList()
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		err = l.parseKRL(data[len(krlMagic):])
+	} else {
+		err = l.parsePlain(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return l, nil
+}
+
+func (l *keyRevocationList) parsePlain(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		l.keys[string(key.Marshal())] = true
+	}
+	return scanner.Err()
+}
+
+// krlReader reads the SSH wire encoding used by KRLs.
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+var errKRLShort = errors.New("truncated key revocation list")
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errKRLShort
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *krlReader) empty() bool {
+	return r.err != nil || len(r.data) == 0
+}
+
+func (l *keyRevocationList) parseKRL(data []byte) error {
+	r := &krlReader{data: data}
+	if version := r.uint32(); r.err == nil && version != 1 {
+		return fmt.Errorf("unsupported KRL format version %d", version)
+	}
+	r.uint64() // krl_version
+	r.uint64() // generated_date
+	r.uint64() // flags
+	r.string() // reserved
+	r.string() // comment
+
+	for !r.empty() {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch sectionType {
+		case krlSectionCertificates:
+			if err := l.parseKRLCerts(section); err != nil {
+				return err
+			}
+		case krlSectionExplicitKey:
+			for !section.empty() {
+				blob := section.string()
+				if section.err == nil {
+					l.keys[string(blob)] = true
+				}
+			}
+		case krlSectionFingerprintSHA1:
+			for !section.empty() {
+				l.sha1[string(section.string())] = true
+			}
+		case krlSectionFingerprintSHA256:
+			for !section.empty() {
+				l.sha256[string(section.string())] = true
+			}
+		case krlSectionSignature:
+			// signatures follow all revocation sections
+			return r.err
+		default:
+			return fmt.Errorf("unknown KRL section type %d", sectionType)
+		}
+		if section.err != nil {
+			return section.err
+		}
+	}
+	return r.err
+}
+
+func (l *keyRevocationList) parseKRLCerts(r *krlReader) error {
+	cs := &krlCertSection{
+		ca:      r.string(),
+		serials: make(map[uint64]bool),
+		keyIDs:  make(map[string]bool),
+	}
+	r.string() // reserved
+	for !r.empty() {
+		subType := r.byte()
+		sub := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch subType {
+		case krlCertSerialList:
+			for !sub.empty() {
+				cs.serials[sub.uint64()] = true
+			}
+		case krlCertSerialRange:
+			cs.ranges = append(cs.ranges, [2]uint64{sub.uint64(), sub.uint64()})
+		case krlCertSerialBitmap:
+			offset := sub.uint64()
+			bitmap := new(big.Int).SetBytes(sub.string())
+			for i := 0; i < bitmap.BitLen(); i++ {
+				if bitmap.Bit(i) == 1 {
+					cs.serials[offset+uint64(i)] = true
+				}
+			}
+		case krlCertKeyID:
+			for !sub.empty() {
+				cs.keyIDs[string(sub.string())] = true
+			}
+		default:
+			return fmt.Errorf("unknown KRL certificate section type %#x", subType)
+		}
+		if sub.err != nil {
+			return sub.err
+		}
+	}
+	l.certs = append(l.certs, cs)
+	return r.err
+}
+
+// revoked reports whether key is revoked. A certificate is also revoked
+// when its key or the key of its CA is.
+func (l *keyRevocationList) revoked(key gossh.PublicKey) bool {
+	if l == nil {
+		return false
+	}
+	if l.keyRevoked(key) {
+		return true
+	}
+	if cert, ok := key.(*gossh.Certificate); ok {
+		return l.keyRevoked(cert.Key) || l.keyRevoked(cert.SignatureKey) || l.certRevoked(cert)
+	}
+	return false
+}
+
+func (l *keyRevocationList) keyRevoked(key gossh.PublicKey) bool {
+	blob := key.Marshal()
+	sum1 := sha1.Sum(blob)
+	sum256 := sha256.Sum256(blob)
+	return l.keys[string(blob)] || l.sha1[string(sum1[:])] || l.sha256[string(sum256[:])]
+}
+
+func (l *keyRevocationList) certRevoked(cert *gossh.Certificate) bool {
+	ca := cert.SignatureKey.Marshal()
+	for _, cs := range l.certs {
+		if len(cs.ca) > 0 && !bytes.Equal(cs.ca, ca) {
+			continue
+		}
+		if cs.serials[cert.Serial] || cs.keyIDs[cert.KeyId] {
+			return true
+		}
+		for _, rng := range cs.ranges {
+			if cert.Serial >= rng[0] && cert.Serial <= rng[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testKRL was made by ssh-keygen -k -s ca.pub from the testSigner keys
+// with this spec:
+//
+//	ssh-ed25519 ... (testSigner(1), revoked explicitly)
+//	sha1: ssh-ed25519 ... (testSigner(2))
+//	hash: SHA256:zbv/nU7iZdO0fB0DalMI70dP6/yFD8sctXvvW4+OokY (testSigner(3))
+//	serial: 5
+//	serial: 1000
+//	serial: 10-20
+//	serial: 100000-200000
+//	id: revoked-id
+//
+// with testSigner(5) as CA. It holds every section type and certificate
+// subsection type the parser knows.
+const testKRL = "U1NIS1JMCgAAAAABAAAAAAAAAAAAAAAAatSBMAAAAAAAAAAAAAAAAAAAAAABAAAAhAAAADMAAAALc3NoLWVkMjU1MTkAAAAgbnoc3Smwt4/ROvTFWY/v9O8qlxZuPKby5Pv8zYBQW/EAAAAAIgAAAA8AAAAAAAAABQAAAAMA/+EgAAAACAAAAAAAAAPoIQAAABAAAAAAAAGGoAAAAAAAAw1AIwAAAA4AAAAKcmV2b2tlZC1pZAIAAAA3AAAAMwAAAAtzc2gtZWQyNTUxOQAAACCKiOPddAnxlf1S2y08ul1yymcJvx2UEhvzdIgBtA9vXAMAAAAYAAAAFESptZKob4/mJyqVmbzLmJf5H0sqBQAAACQAAAAgzbv/nU7iZdO0fB0DalMI70dP6/yFD8sctXvvW4+OokY="
+
+// testSigner returns the ed25519 key whose seed is all seed bytes.
+func testSigner(t *testing.T, seed byte) gossh.Signer {
+	s := make([]byte, ed25519.SeedSize)
+	for i := range s {
+		s[i] = seed
+	}
+	signer, err := gossh.NewSignerFromKey(ed25519.NewKeyFromSeed(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func testCert(t *testing.T, key gossh.PublicKey, ca gossh.Signer, serial uint64, keyID string) *gossh.Certificate {
+	cert := &gossh.Certificate{
+		Key:         key,
+		Serial:      serial,
+		CertType:    gossh.UserCert,
+		KeyId:       keyID,
+		ValidBefore: gossh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	fileName := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestLoadRevokedKeysKRL(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testKRL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := loadRevokedKeys(writeTestFile(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := testSigner(t, 4).PublicKey()
+	ca := testSigner(t, 5)
+	otherCA := testSigner(t, 6)
+	tests := []struct {
+		name    string
+		key     gossh.PublicKey
+		revoked bool
+	}{
+		{"explicit key", testSigner(t, 1).PublicKey(), true},
+		{"sha1 fingerprint", testSigner(t, 2).PublicKey(), true},
+		{"sha256 fingerprint", testSigner(t, 3).PublicKey(), true},
+		{"other key", good, false},
+		{"certificate of revoked key", testCert(t, testSigner(t, 1).PublicKey(), otherCA, 1, ""), true},
+		{"serial in bitmap", testCert(t, good, ca, 5, ""), true},
+		{"serial between bitmap bits", testCert(t, good, ca, 6, ""), false},
+		{"serial in list", testCert(t, good, ca, 1000, ""), true},
+		{"first serial of range", testCert(t, good, ca, 100000, ""), true},
+		{"last serial of range", testCert(t, good, ca, 200000, ""), true},
+		{"serial after range", testCert(t, good, ca, 200001, ""), false},
+		{"key id", testCert(t, good, ca, 7, "revoked-id"), true},
+		{"other key id", testCert(t, good, ca, 7, "good-id"), false},
+		{"serial of other CA", testCert(t, good, otherCA, 5, "revoked-id"), false},
+	}
+	for _, tt := range tests {
+		if got := l.revoked(tt.key); got != tt.revoked {
+			t.Errorf("%s: revoked = %v, want %v", tt.name, got, tt.revoked)
+		}
+	}
+}
+
+func TestLoadRevokedKeysPlain(t *testing.T) {
+	revoked := testSigner(t, 1).PublicKey()
+	data := append([]byte("# revoked keys\n\n"), gossh.MarshalAuthorizedKey(revoked)...)
+	l, err := loadRevokedKeys(writeTestFile(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.revoked(revoked) {
+		t.Error("listed key not revoked")
+	}
+	if l.revoked(testSigner(t, 4).PublicKey()) {
+		t.Error("unlisted key revoked")
+	}
+}
+
+func TestLoadRevokedKeysInvalid(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testKRL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string][]byte{
+		"truncated KRL":   data[:len(data)-10],
+		"unknown section": append(append([]byte{}, data[:44]...), 9, 0, 0, 0, 0),
+		"invalid key":     []byte("ssh-ed25519 invalid\n"),
+	}
+	for name, data := range tests {
+		if _, err := loadRevokedKeys(writeTestFile(t, data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := loadRevokedKeys(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// scpSession speaks the server side of the SCP protocol natively, so scp
+// works on systems without an scp binary. File access goes through the same
+// sftpFS policy as the SFTP subsystem.
+type scpSession struct {
+	fs       *sftpFS
+	startDir string
+	in       *bufio.Reader
+	out      io.Writer
+
+	recursive   bool
+	preserve    bool
+	targetIsDir bool
+	sink        bool
+	source      bool
+	paths       []string
+
+	hadError bool
+}
+
+// isSCPCommand reports whether args is an `scp -t` or `scp -f` invocation.
+func isSCPCommand(args []string) bool {
+	if len(args) < 2 || path.Base(args[0]) != "scp" {
+		return false
+	}
+	for _, arg := range args[1:] {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		if strings.ContainsAny(arg, "tf") {
+			return true
+		}
+	}
+	return false
+}
+
+// runSCP serves an `scp -t` or `scp -f` request and returns the exit status.
+func runSCP(opts *sshdOptions, s ssh.Session, args []string) int {
+	fs, startDir, err := sessionFS(opts, s)
+	if err != nil {
+		fmt.Fprintf(s.Stderr(), "scp: %s\n", err)
+		return 1
+	}
+	scp := &scpSession{
+		fs:       fs,
+		startDir: startDir,
+		in:       bufio.NewReader(s),
+		out:      s,
+	}
+	if err := scp.parseArgs(args[1:]); err != nil {
+		fmt.Fprintf(s.Stderr(), "scp: %s\n", err)
+		return 1
+	}
+
+	if scp.sink {
+		err = scp.runSink()
+	} else {
+		err = scp.runSource()
+	}
+	if err != nil {
+		log.Printf("scp %s@%s: %s", s.User(), s.RemoteAddr(), err)
+		return 1
+	}
+	if scp.hadError {
+		return 1
+	}
+	return 0
+}
+
+func (scp *scpSession) parseArgs(args []string) error {
+	for i, arg := range args {
+		if arg == "--" {
+			scp.paths = args[i+1:]
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			scp.paths = args[i:]
+			break
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'r':
+				scp.recursive = true
+			case 'p':
+				scp.preserve = true
+			case 'd':
+				scp.targetIsDir = true
+			case 't':
+				scp.sink = true
+			case 'f':
+				scp.source = true
+			case 'v', 'q':
+			default:
+				return fmt.Errorf("unsupported option -%c", c)
+			}
+		}
+	}
+	if scp.sink == scp.source {
+		return fmt.Errorf("exactly one of -t and -f is required")
+	}
+	if len(scp.paths) == 0 || (scp.sink && len(scp.paths) != 1) {
+		return fmt.Errorf("invalid path arguments")
+	}
+	return nil
+}
+
+// clientPath makes a path given on the scp command line absolute.
+func (scp *scpSession) clientPath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(scp.startDir, p)
+}
+
+// scpErrorText strips the local path from file system errors, it would
+// reveal the location of the SFTP root.
+func scpErrorText(err error) string {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// sendError reports a non fatal error to the client and carries on.
+func (scp *scpSession) sendError(format string, a ...interface{}) error {
+	scp.hadError = true
+	msg := fmt.Sprintf(format, a...)
+	log.Printf("scp: %s", msg)
+	_, err := fmt.Fprintf(scp.out, "\x01scp: %s\n", strings.ReplaceAll(msg, "\n", " "))
+	return err
+}
+
+func (scp *scpSession) ack() error {
+	_, err := scp.out.Write([]byte{0})
+	return err
+}
+
+// readAck waits for the client's reply to the last message.
+func (scp *scpSession) readAck() error {
+	b, err := scp.in.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := scp.in.ReadString('\n')
+		msg = strings.TrimSpace(msg)
+		if b == 1 {
+			scp.hadError = true
+			log.Printf("scp client warning: %s", msg)
+			return nil
+		}
+		return errors.New(msg)
+	default:
+		return fmt.Errorf("unexpected scp reply %q", b)
+	}
+}
+
+// scpTimes holds the times of a T message until the next file or directory.
+type scpTimes struct {
+	mtime, atime time.Time
+}
+
+func parseSCPTimes(line string) (*scpTimes, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid times %q", line)
+	}
+	mtime, err1 := strconv.ParseInt(fields[0], 10, 64)
+	atime, err2 := strconv.ParseInt(fields[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid times %q", line)
+	}
+	return &scpTimes{mtime: time.Unix(mtime, 0), atime: time.Unix(atime, 0)}, nil
+}
+
+// parseSCPEntry parses the "mode size name" part of a C or D message.
+func parseSCPEntry(line string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid entry %q", line)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid mode %q", fields[0])
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid size %q", fields[1])
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("invalid name %q", name)
+	}
+	return os.FileMode(mode) & os.ModePerm, size, name, nil
+}
+
+// runSink receives files from the client (scp -t).
+func (scp *scpSession) runSink() error {
+	if scp.fs.readOnly {
+		fmt.Fprintf(scp.out, "\x02scp: read-only file system\n")
+		return errors.New("read-only file system")
+	}
+
+	target := scp.clientPath(scp.paths[0])
+	targetExists := false
+	if localPath, err := scp.fs.resolve(target, true); err == nil {
+		if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
+			targetExists = true
+		}
+	}
+	if scp.targetIsDir && !targetExists {
+		fmt.Fprintf(scp.out, "\x02scp: %s: not a directory\n", target)
+		return fmt.Errorf("%s: not a directory", target)
+	}
+
+	// dirs holds the client paths of the directories being received,
+	// dirTimes their pending -p times
+	dirs := []string{target}
+	dirTimes := []*scpTimes{nil}
+	var times *scpTimes
+
+	if err := scp.ack(); err != nil {
+		return err
+	}
+	for {
+		line, err := scp.in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("empty scp message")
+		}
+
+		msgType, body := line[0], line[1:]
+		switch msgType {
+		case 1, 2:
+			log.Printf("scp client error: %s", body)
+			scp.hadError = true
+			if msgType == 2 {
+				return errors.New(body)
+			}
+			continue
+
+		case 'T':
+			times, err = parseSCPTimes(body)
+			if err != nil {
+				return err
+			}
+			if err := scp.ack(); err != nil {
+				return err
+			}
+			continue
+
+		case 'E':
+			if len(dirs) == 1 {
+				return fmt.Errorf("unexpected end of directory")
+			}
+			dir, t := dirs[len(dirs)-1], dirTimes[len(dirTimes)-1]
+			dirs, dirTimes = dirs[:len(dirs)-1], dirTimes[:len(dirTimes)-1]
+			if t != nil {
+				if localPath, err := scp.fs.resolve(dir, true); err == nil {
+					os.Chtimes(localPath, t.atime, t.mtime)
+				}
+			}
+			if err := scp.ack(); err != nil {
+				return err
+			}
+			continue
+
+		case 'C', 'D':
+		default:
+			return fmt.Errorf("unexpected scp message %q", line)
+		}
+
+		mode, size, name, err := parseSCPEntry(body)
+		if err != nil {
+			return err
+		}
+		entryTimes := times
+		times = nil
+
+		// the name given on the command line replaces the name of the
+		// top level entry unless it is an existing directory
+		clientPath := dirs[len(dirs)-1]
+		if len(dirs) > 1 || targetExists {
+			clientPath = path.Join(clientPath, name)
+		}
+
+		if msgType == 'D' {
+			if !scp.recursive {
+				return fmt.Errorf("received directory without -r")
+			}
+			if err := scp.mkdir(clientPath, mode); err != nil {
+				if err := scp.sendError("%s: %s", clientPath, scpErrorText(err)); err != nil {
+					return err
+				}
+				// skip the directory, the client stops after the error
+				continue
+			}
+			dirs = append(dirs, clientPath)
+			dirTimes = append(dirTimes, entryTimes)
+			if err := scp.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := scp.receiveFile(clientPath, mode, size, entryTimes); err != nil {
+			return err
+		}
+	}
+}
+
+func (scp *scpSession) mkdir(clientPath string, mode os.FileMode) error {
+	localPath, err := scp.fs.resolve(clientPath, true)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(localPath); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("not a directory")
+		}
+		if scp.preserve {
+			return os.Chmod(localPath, mode)
+		}
+		return nil
+	}
+	return os.Mkdir(localPath, mode|0700)
+}
+
+func (scp *scpSession) receiveFile(clientPath string, mode os.FileMode, size int64, times *scpTimes) error {
+	localPath, err := scp.fs.resolve(clientPath, true)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	}
+	if err != nil {
+		return scp.sendError("%s: %s", clientPath, scpErrorText(err))
+	}
+	defer f.Close()
+
+	if err := scp.ack(); err != nil {
+		return err
+	}
+	data := &io.LimitedReader{R: scp.in, N: size}
+	_, writeErr := io.Copy(f, data)
+	if writeErr != nil {
+		// skip the rest of the file to keep the stream in sync with the
+		// client
+		io.Copy(io.Discard, data)
+	}
+	if data.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if err := scp.readAck(); err != nil {
+		return err
+	}
+
+	if writeErr == nil {
+		writeErr = f.Close()
+	}
+	if writeErr == nil && scp.preserve {
+		writeErr = os.Chmod(localPath, mode)
+		if writeErr == nil && times != nil {
+			writeErr = os.Chtimes(localPath, times.atime, times.mtime)
+		}
+	}
+	if writeErr != nil {
+		return scp.sendError("%s: %s", clientPath, scpErrorText(writeErr))
+	}
+	return scp.ack()
+}
+
+// runSource sends files to the client (scp -f).
+func (scp *scpSession) runSource() error {
+	if err := scp.readAck(); err != nil {
+		return err
+	}
+	for _, p := range scp.paths {
+		if err := scp.send(scp.clientPath(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (scp *scpSession) send(clientPath string) error {
+	localPath, err := scp.fs.resolve(clientPath, true)
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = os.Stat(localPath)
+	}
+	if err != nil {
+		return scp.sendError("%s: %s", clientPath, scpErrorText(err))
+	}
+
+	if scp.preserve {
+		atime := fi.ModTime()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			atime = time.Unix(st.Atim.Unix())
+		}
+		if _, err := fmt.Fprintf(scp.out, "T%d 0 %d 0\n", fi.ModTime().Unix(), atime.Unix()); err != nil {
+			return err
+		}
+		if err := scp.readAck(); err != nil {
+			return err
+		}
+	}
+
+	name := path.Base(clientPath)
+	if fi.IsDir() {
+		if !scp.recursive {
+			return scp.sendError("%s: not a regular file", clientPath)
+		}
+		return scp.sendDir(clientPath, localPath, name, fi)
+	}
+	if !fi.Mode().IsRegular() {
+		return scp.sendError("%s: not a regular file", clientPath)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return scp.sendError("%s: %s", clientPath, scpErrorText(err))
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(scp.out, "C%04o %d %s\n", fi.Mode().Perm(), fi.Size(), name); err != nil {
+		return err
+	}
+	if err := scp.readAck(); err != nil {
+		return err
+	}
+	n, err := io.CopyN(scp.out, f, fi.Size())
+	if err != nil && n < fi.Size() {
+		// the client expects exactly size bytes
+		io.CopyN(scp.out, zeroReader{}, fi.Size()-n)
+		scp.sendError("%s: %s", clientPath, scpErrorText(err))
+	} else if err := scp.ack(); err != nil {
+		return err
+	}
+	return scp.readAck()
+}
+
+func (scp *scpSession) sendDir(clientPath, localPath, name string, fi os.FileInfo) error {
+	entries, err := os.ReadDir(localPath)
+	if err != nil {
+		return scp.sendError("%s: %s", clientPath, scpErrorText(err))
+	}
+	if _, err := fmt.Fprintf(scp.out, "D%04o 0 %s\n", fi.Mode().Perm(), name); err != nil {
+		return err
+	}
+	if err := scp.readAck(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := scp.send(path.Join(clientPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(scp.out, "E\n"); err != nil {
+		return err
+	}
+	return scp.readAck()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
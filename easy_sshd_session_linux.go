@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gliderlabs/ssh"
+)
+
+// sessionHandler runs the requested command, or the configured shell when
+// the client did not ask for one, with or without a PTY. The forced command
+// of a restricted key replaces both, as well as subsystems.
+func sessionHandler(opts *sshdOptions) ssh.Handler {
+	named := newSessionManager(opts)
+	return func(s ssh.Session) {
+		u := sessionUser(s.Context())
+		command := u.Command
+		if s.RawCommand() != "" {
+			command = s.RawCommand()
+		}
+		env := loginEnviron(opts, s, u)
+		args := s.Command()
+		attach := false
+		if ak := sessionAuthorizedKey(s.Context()); ak != nil && ak.Command != "" {
+			original := s.RawCommand()
+			if s.Subsystem() != "" {
+				original = s.Subsystem()
+			}
+			command = ak.Command
+			env = append(env, fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s", original))
+		} else if isSCPCommand(args) {
+			audit(s.Context(), auditEvent{Event: "scp", Command: s.RawCommand()})
+			status := runSCP(opts, s, args)
+			audit(s.Context(), auditEvent{Event: "exit", Command: s.RawCommand(), Status: &status})
+			s.Exit(status)
+			return
+		} else {
+			attach = isAttachCommand(args)
+		}
+
+		// a named session keeps the socket of the client that started it,
+		// which goes away when that client detaches, like under tmux
+		if sock, stop := startAgentForwarding(opts, s); sock != "" {
+			defer stop()
+			env = append(env, "SSH_AUTH_SOCK="+sock)
+		}
+
+		if attach {
+			cmd := exec.Command("sh", "-c", u.Command)
+			cmd.Env = env
+			cmd.Dir = u.homeDir()
+			audit(s.Context(), auditEvent{Event: "attach", Command: s.RawCommand()})
+			status := named.run(s, args, cmd)
+			audit(s.Context(), auditEvent{Event: "exit", Command: s.RawCommand(), Status: &status})
+			s.Exit(status)
+			return
+		}
+
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = env
+		cmd.Dir = u.homeDir()
+
+		event := "exec"
+		if s.RawCommand() == "" && s.Subsystem() == "" {
+			event = "shell"
+		}
+		audit(s.Context(), auditEvent{Event: event, Command: command})
+
+		var err error
+		if _, _, isPty := s.Pty(); isPty {
+			err = runPtySession(opts, s, cmd)
+		} else {
+			err = runExecSession(s, cmd)
+		}
+		endSession(s, command, err)
+	}
+}
+
+// endSession records how command ended, with err from cmd.Wait, and
+// reports it to the client.
+func endSession(s ssh.Session, command string, err error) {
+	ev := auditEvent{Event: "exit", Command: command}
+	if sig, _, ok := exitSignal(err); ok {
+		ev.Signal = string(sig)
+	} else {
+		status := exitStatus(err)
+		ev.Status = &status
+	}
+	audit(s.Context(), ev)
+	exitSession(s, err)
+}
+
+// startPty starts cmd as session leader on a new PTY of the requested
+// size and terminal type, and returns the PTY's controlling side.
+func startPty(cmd *exec.Cmd, ptyReq ssh.Pty) (*os.File, error) {
+	f, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	setWinsize(f, ptyReq.Window.Width, ptyReq.Window.Height)
+
+	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term), fmt.Sprintf("SSH_TTY=%s", tty.Name()))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	err = cmd.Start()
+	tty.Close()
+	if err != nil {
+		f.Close()
+		log.Printf("start %q: %s", cmd.Args, err)
+		return nil, err
+	}
+	return f, nil
+}
+
+func runPtySession(opts *sshdOptions, s ssh.Session, cmd *exec.Cmd) error {
+	ptyReq, winCh, _ := s.Pty()
+	f, err := startPty(cmd, ptyReq)
+	if err != nil {
+		fmt.Fprintf(s.Stderr(), "%s\n", err)
+		return err
+	}
+	defer f.Close()
+	defer superviseProcess(s, cmd)()
+
+	var output io.Writer = s
+	rec := startRecording(opts, s, cmd)
+	if rec != nil {
+		defer rec.Close()
+		output = io.MultiWriter(output, rec)
+	}
+
+	go func() {
+		for win := range winCh {
+			setWinsize(f, win.Width, win.Height)
+			if rec != nil {
+				rec.Resize(win.Width, win.Height)
+			}
+		}
+	}()
+	go func() {
+		io.Copy(f, s) // stdin
+	}()
+	io.Copy(output, f) // stdout
+	return cmd.Wait()
+}
+
+// startAgentForwarding serves the client's ssh-agent on a new socket when
+// the client asked for it and it is allowed. It returns the socket path, or
+// "" when not forwarding, and a function removing the socket again.
+func startAgentForwarding(opts *sshdOptions, s ssh.Session) (string, func()) {
+	if !ssh.AgentRequested(s) {
+		return "", nil
+	}
+	if ak := sessionAuthorizedKey(s.Context()); !opts.AllowAgentForwarding || (ak != nil && ak.NoAgentForwarding) {
+		log.Printf("%s@%s agent forwarding denied", s.User(), s.RemoteAddr())
+		return "", nil
+	}
+	l, err := ssh.NewAgentListener()
+	if err != nil {
+		log.Printf("agent forwarding: %s", err)
+		return "", nil
+	}
+	go ssh.ForwardAgentConnections(l, s)
+	sock := l.Addr().String()
+	return sock, func() {
+		l.Close()
+		os.RemoveAll(filepath.Dir(sock))
+	}
+}
+
+// startRecording opens an asciicast recording of the session in -record-dir.
+// It returns nil when recording is disabled or the file cannot be created.
+func startRecording(opts *sshdOptions, s ssh.Session, cmd *exec.Cmd) *asciicastWriter {
+	if opts.RecordDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(opts.RecordDir, 0700); err != nil {
+		log.Printf("recording disabled: %s", err)
+		return nil
+	}
+
+	ptyReq, _, _ := s.Pty()
+	addr := strings.NewReplacer(":", "_", "[", "", "]", "", "/", "_").Replace(s.RemoteAddr().String())
+	fileName := filepath.Join(opts.RecordDir, fmt.Sprintf("%s_%s_%s.cast", s.User(), time.Now().Format("20060102-150405"), addr))
+	rec, err := newAsciicastWriter(fileName, asciicastHeader{
+		Width:  ptyReq.Window.Width,
+		Height: ptyReq.Window.Height,
+		Title:  fmt.Sprintf("%s@%s %s", s.User(), s.RemoteAddr(), strings.Join(cmd.Args, " ")),
+		Env:    map[string]string{"TERM": ptyReq.Term},
+	})
+	if err != nil {
+		log.Printf("recording disabled: %s", err)
+		return nil
+	}
+	log.Printf("Recording session of %s@%s to %s", s.User(), s.RemoteAddr(), fileName)
+	return rec
+}
+
+// runExecSession runs cmd with its stdin, stdout and stderr bridged to the
+// session channel.
+func runExecSession(s ssh.Session, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = s
+	cmd.Stderr = s.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		log.Printf("start %q: %s", cmd.Args, err)
+		fmt.Fprintf(s.Stderr(), "%s\n", err)
+		return err
+	}
+	defer superviseProcess(s, cmd)()
+	go func() {
+		io.Copy(stdin, s)
+		stdin.Close()
+	}()
+	return cmd.Wait()
+}
+
+// exitStatus converts the result of cmd.Wait into the status reported to
+// the client.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+		return exitErr.ExitCode()
+	}
+	return 255
+}
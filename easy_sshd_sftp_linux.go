@@ -0,0 +1,510 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// SftpHandler handler for SFTP subsystem. File access is confined to the
+// user's SFTP root and checked per operation.
+func SftpHandler(opts *sshdOptions) ssh.SubsystemHandler {
+	return func(sess ssh.Session) {
+		fs, startDir, err := sessionFS(opts, sess)
+		if err != nil {
+			log.Printf("sftp server init error: %s\n", err)
+			return
+		}
+
+		server := sftp.NewRequestServer(
+			sess,
+			sftp.Handlers{
+				FileGet:  fs,
+				FilePut:  fs,
+				FileCmd:  fs,
+				FileList: fs,
+			},
+			sftp.WithStartDirectory(startDir),
+		)
+		if err := server.Serve(); err == io.EOF {
+			server.Close()
+			fmt.Println("sftp client exited session.")
+		} else if err != nil {
+			fmt.Println("sftp server completed with error:", err)
+		}
+	}
+}
+
+// sessionFS returns the file system a session may access for file
+// transfers, and the directory relative client paths start from.
+func sessionFS(opts *sshdOptions, sess ssh.Session) (*sftpFS, string, error) {
+	root := opts.SftpRoot
+	startDir := ""
+	if u := sessionUser(sess.Context()); u != nil {
+		if u.SftpRoot != "" {
+			root = u.SftpRoot
+		}
+		startDir = u.Home
+	}
+	if root == "" {
+		root = "/"
+	}
+	fs, err := newSftpFS(root, opts.SftpReadOnly)
+	if err != nil {
+		return nil, "", err
+	}
+	fs.ctx = sess.Context()
+	if fs.root != "/" {
+		// inside a chroot the client starts at its root
+		startDir = "/"
+	} else if startDir == "" {
+		startDir, _ = os.Getwd()
+	}
+	return fs, startDir, nil
+}
+
+// sftpFS implements the sftp request server handlers on the local file
+// system below root.
+type sftpFS struct {
+	root     string
+	readOnly bool
+	ctx      ssh.Context
+}
+
+func newSftpFS(root string, readOnly bool) (*sftpFS, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFS{root: root, readOnly: readOnly}, nil
+}
+
+// resolve maps a client path to a local path below root. Symbolic links in
+// the path are resolved and any path leaving root is refused. The last
+// element is only resolved when followLast is set, so that operations on a
+// link itself (lstat, remove, rename) stay possible.
+func (fs *sftpFS) resolve(clientPath string, followLast bool) (string, error) {
+	clean := path.Clean("/" + clientPath)
+	if clean == "/" {
+		return fs.root, nil
+	}
+
+	dir, base := path.Split(clean)
+	localDir, err := evalExistingSymlinks(filepath.Join(fs.root, filepath.FromSlash(dir)))
+	if err != nil {
+		return "", err
+	}
+	localPath := filepath.Join(localDir, base)
+
+	if followLast {
+		if fi, err := os.Lstat(localPath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			target, err := filepath.EvalSymlinks(localPath)
+			if err != nil {
+				// a dangling link could be used to create a file outside root
+				return "", sftp.ErrSSHFxPermissionDenied
+			}
+			localPath = target
+		}
+	}
+
+	if !fs.contains(localPath) {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	return localPath, nil
+}
+
+func (fs *sftpFS) contains(localPath string) bool {
+	if fs.root == "/" {
+		return true
+	}
+	return localPath == fs.root || strings.HasPrefix(localPath, fs.root+string(filepath.Separator))
+}
+
+// clientPath maps a local path below root back to the path the client sees.
+func (fs *sftpFS) clientPath(localPath string) (string, bool) {
+	if !fs.contains(localPath) {
+		return "", false
+	}
+	rel, err := filepath.Rel(fs.root, localPath)
+	if err != nil {
+		return "", false
+	}
+	return path.Join("/", filepath.ToSlash(rel)), true
+}
+
+// evalExistingSymlinks resolves the symbolic links of the longest existing
+// prefix of p and appends the rest unchanged. A dangling link in p is
+// refused, as where the rest ends up depends on what its target becomes.
+func evalExistingSymlinks(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err == nil {
+		return real, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, err := os.Lstat(p); err == nil {
+		return "", sftp.ErrSSHFxPermissionDenied
+	}
+	parent := filepath.Dir(p)
+	if parent == p {
+		return p, nil
+	}
+	realParent, err := evalExistingSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(realParent, filepath.Base(p)), nil
+}
+
+// logRequest records an SFTP request in the audit log. Opening a file is
+// logged as sftp_open whichever way the client asked for it.
+func (fs *sftpFS) logRequest(r *sftp.Request, flags string, err error) {
+	method := strings.ToLower(r.Method)
+	switch r.Method {
+	case "Get", "Put", "Open":
+		method = "open"
+	}
+	ev := auditEvent{
+		Event:  "sftp_" + method,
+		Path:   r.Filepath,
+		Target: r.Target,
+		Flags:  flags,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	audit(fs.ctx, ev)
+}
+
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := fs.fileread(r)
+	fs.logRequest(r, "read", err)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFile{File: f, ctx: fs.ctx, clientPath: r.Filepath}, nil
+}
+
+func (fs *sftpFS) fileread(r *sftp.Request) (*os.File, error) {
+	localPath, err := fs.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(localPath)
+}
+
+func (fs *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	f, err := fs.openFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *sftpFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	f, err := fs.openFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *sftpFS) openFile(r *sftp.Request) (*auditFile, error) {
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	names := []string{"write"}
+	if pflags.Read {
+		flags = os.O_RDWR
+		names = []string{"read", "write"}
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+		names = append(names, "create")
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+		names = append(names, "truncate")
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+		names = append(names, "exclusive")
+	}
+
+	f, err := fs.openLocal(r, flags)
+	fs.logRequest(r, strings.Join(names, ","), err)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFile{File: f, ctx: fs.ctx, clientPath: r.Filepath}, nil
+}
+
+func (fs *sftpFS) openLocal(r *sftp.Request, flags int) (*os.File, error) {
+	if fs.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	localPath, err := fs.resolve(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	mode := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		mode = r.Attributes().FileMode().Perm()
+	}
+	return os.OpenFile(localPath, flags, mode)
+}
+
+func (fs *sftpFS) Filecmd(r *sftp.Request) error {
+	err := fs.filecmd(r)
+	flags := ""
+	if r.Method == "Setstat" {
+		flags = setstatFlags(r)
+	}
+	fs.logRequest(r, flags, err)
+	return err
+}
+
+func (fs *sftpFS) filecmd(r *sftp.Request) error {
+	if fs.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	switch r.Method {
+	case "Setstat":
+		localPath, err := fs.resolve(r.Filepath, true)
+		if err != nil {
+			return err
+		}
+		return setstat(localPath, r)
+
+	case "Rename":
+		oldPath, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		newPath, err := fs.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(newPath); err == nil {
+			return os.ErrExist
+		}
+		return os.Rename(oldPath, newPath)
+
+	case "Rmdir":
+		localPath, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Lstat(localPath)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s: not a directory", r.Filepath)
+		}
+		return os.Remove(localPath)
+
+	case "Remove":
+		localPath, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Lstat(localPath)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return fmt.Errorf("%s: is a directory", r.Filepath)
+		}
+		return os.Remove(localPath)
+
+	case "Mkdir":
+		localPath, err := fs.resolve(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Mkdir(localPath, 0755)
+
+	case "Link":
+		oldPath, err := fs.resolve(r.Filepath, true)
+		if err != nil {
+			return err
+		}
+		newPath, err := fs.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return os.Link(oldPath, newPath)
+
+	case "Symlink":
+		// r.Filepath is the link target as given by the client and
+		// r.Target is the link to create
+		linkPath, err := fs.resolve(r.Target, false)
+		if err != nil {
+			return err
+		}
+		target := r.Filepath
+		if path.IsAbs(target) {
+			target = filepath.Join(fs.root, filepath.FromSlash(path.Clean(target)))
+		}
+		return os.Symlink(target, linkPath)
+	}
+	return fmt.Errorf("unsupported method %s", r.Method)
+}
+
+func (fs *sftpFS) PosixRename(r *sftp.Request) error {
+	err := fs.posixRename(r)
+	fs.logRequest(r, "", err)
+	return err
+}
+
+func (fs *sftpFS) posixRename(r *sftp.Request) error {
+	if fs.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	oldPath, err := fs.resolve(r.Filepath, false)
+	if err != nil {
+		return err
+	}
+	newPath, err := fs.resolve(r.Target, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// setstatFlags describes the attributes a Setstat request changes.
+func setstatFlags(r *sftp.Request) string {
+	attrFlags := r.AttrFlags()
+	attrs := r.Attributes()
+	var names []string
+	if attrFlags.Size {
+		names = append(names, fmt.Sprintf("size=%d", attrs.Size))
+	}
+	if attrFlags.Permissions {
+		names = append(names, fmt.Sprintf("mode=%04o", attrs.FileMode().Perm()))
+	}
+	if attrFlags.UidGid {
+		names = append(names, fmt.Sprintf("owner=%d:%d", attrs.UID, attrs.GID))
+	}
+	if attrFlags.Acmodtime {
+		names = append(names, "mtime="+attrs.ModTime().Format(time.RFC3339))
+	}
+	return strings.Join(names, ",")
+}
+
+func setstat(localPath string, r *sftp.Request) error {
+	attrFlags := r.AttrFlags()
+	attrs := r.Attributes()
+	if attrFlags.Size {
+		if err := os.Truncate(localPath, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Permissions {
+		if err := os.Chmod(localPath, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if attrFlags.UidGid {
+		if err := os.Chown(localPath, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Acmodtime {
+		if err := os.Chtimes(localPath, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		localPath, err := fs.resolve(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(localPath)
+		if err != nil {
+			return nil, err
+		}
+		var list listerAt
+		for _, entry := range entries {
+			fi, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			list = append(list, fi)
+		}
+		return list, nil
+
+	case "Stat":
+		localPath, err := fs.resolve(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{fi}, nil
+	}
+	return nil, fmt.Errorf("unsupported method %s", r.Method)
+}
+
+func (fs *sftpFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	localPath, err := fs.resolve(r.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Lstat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{fi}, nil
+}
+
+func (fs *sftpFS) Readlink(clientPath string) (string, error) {
+	localPath, err := fs.resolve(clientPath, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := os.Readlink(localPath)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(target) && fs.root != "/" {
+		if p, ok := fs.clientPath(target); ok {
+			return p, nil
+		}
+	}
+	return filepath.ToSlash(target), nil
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testSftpTree creates a root directory with links into and out of it next
+// to a directory outside of it, and returns the sftpFS of root.
+func testSftpTree(t *testing.T) *sftpFS {
+	base := t.TempDir()
+	for _, dir := range []string{"root/dir", "outside"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"root/dir/file", "outside/secret"} {
+		if err := os.WriteFile(filepath.Join(base, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/abs-in":        filepath.Join(base, "root/dir"),
+		"root/abs-out":       filepath.Join(base, "outside"),
+		"root/rel-in":        "dir",
+		"root/rel-out":       "../outside",
+		"root/dir/up":        "../..",
+		"root/file-out":      "../outside/secret",
+		"root/dangling":      "../outside/new",
+		"root/dangling-in":   "missing",
+		"root/dir/abs-chain": filepath.Join(base, "root/rel-out"),
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(base, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs, err := newSftpFS(filepath.Join(base, "root"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestSftpResolve(t *testing.T) {
+	fs := testSftpTree(t)
+	tests := []struct {
+		clientPath string
+		followLast bool
+		want       string // below fs.root, "" when refused
+	}{
+		{"/", true, "."},
+		{"", true, "."},
+		{"/dir/file", true, "dir/file"},
+		{"dir/file", true, "dir/file"},
+
+		// .. stops at the root like on a real file system
+		{"..", true, "."},
+		{"../../outside/secret", true, "outside/secret"},
+		{"/dir/../../outside", true, "outside"},
+		{"/dir/../../../etc/passwd", false, "etc/passwd"},
+
+		// absolute links
+		{"/abs-in/file", true, "dir/file"},
+		{"/abs-in", true, "dir"},
+		{"/abs-out/secret", true, ""},
+		{"/abs-out", true, ""},
+		{"/abs-out", false, "abs-out"},
+
+		// relative links
+		{"/rel-in/file", true, "dir/file"},
+		{"/rel-out/secret", true, ""},
+		{"/rel-out", true, ""},
+		{"/dir/up/outside/secret", true, ""},
+		{"/dir/up/root/dir/file", true, "dir/file"},
+		{"/file-out", true, ""},
+		{"/file-out", false, "file-out"},
+		{"/dir/abs-chain/secret", true, ""},
+
+		// dangling links, which would create their target when followed
+		{"/dangling", true, ""},
+		{"/dangling", false, "dangling"},
+		{"/dangling/file", true, ""},
+		{"/dangling/file", false, ""},
+		{"/dangling-in", true, ""},
+		{"/dangling-in/file", false, ""},
+
+		// paths that do not exist yet, below linked directories
+		{"/dir/new", true, "dir/new"},
+		{"/dir/new/deeper", true, "dir/new/deeper"},
+		{"/abs-in/new", true, "dir/new"},
+		{"/rel-in/new/deeper", false, "dir/new/deeper"},
+		{"/abs-out/new", true, ""},
+		{"/abs-out/new/deeper", false, ""},
+		{"/rel-out/new", false, ""},
+		{"/dir/up/outside/new", false, ""},
+	}
+	for _, tt := range tests {
+		got, err := fs.resolve(tt.clientPath, tt.followLast)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("resolve(%q, %v) = %s, want refused", tt.clientPath, tt.followLast, got)
+			}
+			continue
+		}
+		want := filepath.Join(fs.root, filepath.FromSlash(tt.want))
+		if err != nil {
+			t.Errorf("resolve(%q, %v): %s, want %s", tt.clientPath, tt.followLast, err, want)
+		} else if got != want {
+			t.Errorf("resolve(%q, %v) = %s, want %s", tt.clientPath, tt.followLast, got, want)
+		}
+	}
+}
+
+func TestSftpContains(t *testing.T) {
+	fs := &sftpFS{root: "/srv/root"}
+	tests := []struct {
+		localPath string
+		contains  bool
+	}{
+		{"/srv/root", true},
+		{"/srv/root/file", true},
+		{"/srv/root/dir/file", true},
+		{"/srv/root2", false},
+		{"/srv/root2/file", false},
+		{"/srv", false},
+		{"/", false},
+	}
+	for _, tt := range tests {
+		if got := fs.contains(tt.localPath); got != tt.contains {
+			t.Errorf("contains(%s) = %v, want %v", tt.localPath, got, tt.contains)
+		}
+		if _, ok := fs.clientPath(tt.localPath); ok != tt.contains {
+			t.Errorf("clientPath(%s) ok = %v, want %v", tt.localPath, ok, tt.contains)
+		}
+	}
+	if !(&sftpFS{root: "/"}).contains("/etc/passwd") {
+		t.Error("root / does not contain /etc/passwd")
+	}
+}
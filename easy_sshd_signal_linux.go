@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// hangupGrace is how long the processes of a session get to exit after the
+// SIGHUP sent on disconnect before they are killed.
+const hangupGrace = 5 * time.Second
+
+// sshSignals maps the signal names of RFC 4254 to the local signals.
+var sshSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// sessionClosed tells that the channel of a session was closed. With
+// several sessions on a connection, that can happen long before the
+// connection goes away.
+type sessionClosed struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newSessionClosed() *sessionClosed {
+	return &sessionClosed{done: make(chan struct{})}
+}
+
+func (c *sessionClosed) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// sessionChannelHandler serves session channels like
+// ssh.DefaultSessionHandler, which returns once the requests of the channel
+// end with its close, and reports that to the session through
+// sessionClosedOf.
+func sessionChannelHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	closed := newSessionClosed()
+	defer closed.close()
+	ssh.DefaultSessionHandler(srv, conn, &closingNewChannel{newChan, closed}, ctx)
+}
+
+type closingNewChannel struct {
+	gossh.NewChannel
+	closed *sessionClosed
+}
+
+func (c *closingNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &closingChannel{ch, c.closed}, reqs, nil
+}
+
+// closingChannel hands out closed with its stderr, the only value of its
+// own a session passes on from the channel it wraps.
+type closingChannel struct {
+	gossh.Channel
+	closed *sessionClosed
+}
+
+func (c *closingChannel) Stderr() io.ReadWriter {
+	return &closingStderr{c.Channel.Stderr(), c.closed}
+}
+
+type closingStderr struct {
+	io.ReadWriter
+	closed *sessionClosed
+}
+
+// sessionClosedOf returns the sessionClosed of a session served by
+// sessionChannelHandler, or one that is never closed.
+func sessionClosedOf(s ssh.Session) *sessionClosed {
+	if stderr, ok := s.Stderr().(*closingStderr); ok {
+		return stderr.closed
+	}
+	return newSessionClosed()
+}
+
+// superviseProcess forwards the client's signal requests to the process
+// group of the started cmd. When the client connection goes away or the
+// session's channel is closed, the group gets SIGHUP, and SIGKILL if it is
+// still around after hangupGrace, so that no shell outlives its session.
+// The returned function stops supervising.
+func superviseProcess(s ssh.Session, cmd *exec.Cmd) func() {
+	pgid := cmd.Process.Pid
+	closed := sessionClosedOf(s)
+	sigCh := make(chan ssh.Signal, 8)
+	s.Signals(sigCh)
+	done := make(chan struct{})
+
+	hangup := func() {
+		syscall.Kill(-pgid, syscall.SIGHUP)
+		select {
+		case <-time.After(hangupGrace):
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		case <-done:
+		}
+	}
+	go func() {
+		for {
+			select {
+			case sig := <-sigCh:
+				if local, ok := sshSignals[sig]; ok {
+					syscall.Kill(-pgid, local)
+				}
+			case <-s.Context().Done():
+				hangup()
+				return
+			case <-closed.done:
+				hangup()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		s.Signals(nil)
+		close(done)
+	}
+}
+
+// exitSignal returns the name of the signal that ended the process of err
+// and whether it dumped core, if it was ended by a signal.
+func exitSignal(err error) (ssh.Signal, bool, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return "", false, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return "", false, false
+	}
+	for name, sig := range sshSignals {
+		if sig == status.Signal() {
+			return name, status.CoreDump(), true
+		}
+	}
+	return "", false, false
+}
+
+// exitSession reports how the command ended to the client, as exit-signal
+// when a signal ended it and as exit-status otherwise, and closes the
+// session.
+func exitSession(s ssh.Session, err error) {
+	sig, coreDumped, ok := exitSignal(err)
+	if !ok {
+		s.Exit(exitStatus(err))
+		return
+	}
+	msg := struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{
+		Signal:     string(sig),
+		CoreDumped: coreDumped,
+		Error:      err.Error(),
+	}
+	s.SendRequest("exit-signal", false, gossh.Marshal(&msg))
+	s.Close()
+}
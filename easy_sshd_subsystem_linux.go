@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path"
+
+	"github.com/gliderlabs/ssh"
+)
+
+// builtinSubsystems are the subsystems implemented by easy-sshd itself.
+var builtinSubsystems = map[string]func(opts *sshdOptions) ssh.SubsystemHandler{
+	"sftp":         SftpHandler,
+	"file-summary": fileSummarySubsystem,
+}
+
+// subsystemHandlers returns the handlers of the builtin sftp subsystem, the
+// subsystems of the -config file and those of -subsystem flags, in
+// increasing precedence. Sessions with a forced command are passed to
+// session instead.
+func subsystemHandlers(opts *sshdOptions, session ssh.Handler) (map[string]ssh.SubsystemHandler, error) {
+	subsystems := map[string]*sshdSubsystem{"sftp": {Builtin: "sftp"}}
+	if opts.Config != "" {
+		config, err := readSSHDConfig(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		for name, sub := range config.Subsystems {
+			subsystems[name] = sub
+		}
+	}
+	for name, sub := range opts.Subsystems {
+		subsystems[name] = sub
+	}
+
+	handlers := make(map[string]ssh.SubsystemHandler)
+	for name, sub := range subsystems {
+		switch {
+		case sub.Builtin != "" && sub.Command != "":
+			return nil, fmt.Errorf("subsystem %s: both command and builtin given", name)
+		case sub.Builtin != "":
+			newHandler, ok := builtinSubsystems[sub.Builtin]
+			if !ok {
+				return nil, fmt.Errorf("subsystem %s: unknown builtin %q", name, sub.Builtin)
+			}
+			handlers[name] = auditSubsystem(name, forcedCommand(session, newHandler(opts)))
+		case sub.Command != "":
+			handlers[name] = auditSubsystem(name, forcedCommand(session, commandSubsystem(opts, sub.Command)))
+		default:
+			return nil, fmt.Errorf("subsystem %s: command or builtin required", name)
+		}
+		if name != "sftp" || sub.Builtin != "sftp" { // not the default
+			log.Printf("Subsystem %s: %s%s", name, sub.Command, sub.Builtin)
+		}
+	}
+	return handlers, nil
+}
+
+func auditSubsystem(name string, next ssh.SubsystemHandler) ssh.SubsystemHandler {
+	return func(s ssh.Session) {
+		audit(s.Context(), auditEvent{Event: "subsystem", Command: name})
+		next(s)
+	}
+}
+
+// forcedCommand runs the forced command of a restricted key or certificate
+// through session instead of the subsystem, as OpenSSH does.
+func forcedCommand(session ssh.Handler, next ssh.SubsystemHandler) ssh.SubsystemHandler {
+	return func(s ssh.Session) {
+		if ak := sessionAuthorizedKey(s.Context()); ak != nil && ak.Command != "" {
+			session(s)
+			return
+		}
+		next(s)
+	}
+}
+
+// commandSubsystem runs command for every request of the subsystem, in the
+// environment and home directory of a login shell.
+func commandSubsystem(opts *sshdOptions, command string) ssh.SubsystemHandler {
+	return func(s ssh.Session) {
+		u := sessionUser(s.Context())
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = loginEnviron(opts, s, u)
+		cmd.Dir = u.homeDir()
+		endSession(s, s.Subsystem(), runExecSession(s, cmd))
+	}
+}
+
+// fileSummaryRequest asks the file-summary subsystem for the summary of a
+// directory, as file-summary -dir Dir -bigfile BigFile would print it.
+type fileSummaryRequest struct {
+	Dir     string `json:"dir"`
+	BigFile int64  `json:"bigfile"`
+}
+
+type fileSummaryResponse struct {
+	Summary []FileSummary `json:"summary"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// fileSummarySubsystem answers every JSON line of fileSummaryRequest with
+// a JSON line of fileSummaryResponse, saving clients a shell round trip to
+// compare directories. Directories are confined like SFTP.
+func fileSummarySubsystem(opts *sshdOptions) ssh.SubsystemHandler {
+	return func(s ssh.Session) {
+		fs, startDir, err := sessionFS(opts, s)
+		if err != nil {
+			log.Printf("file-summary init error: %s", err)
+			s.Exit(1)
+			return
+		}
+		dec := json.NewDecoder(s)
+		enc := json.NewEncoder(s)
+		for {
+			var req fileSummaryRequest
+			if err := dec.Decode(&req); err != nil {
+				if err != io.EOF {
+					enc.Encode(fileSummaryResponse{Error: err.Error()})
+				}
+				break
+			}
+			if req.BigFile <= 0 {
+				req.BigFile = Size10MB
+			}
+			dir := req.Dir
+			if !path.IsAbs(dir) {
+				dir = path.Join(startDir, dir)
+			}
+
+			var resp fileSummaryResponse
+			if localDir, err := fs.resolve(dir, true); err != nil {
+				resp.Error = err.Error()
+			} else if resp.Summary, err = getDirSummary(localDir, req.BigFile); err != nil {
+				resp.Error = err.Error()
+			}
+			if err := enc.Encode(resp); err != nil {
+				break
+			}
+		}
+		s.Exit(0)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// authThrottle slows down and bans client addresses that keep failing to
+// log in. Failures of an address are forgotten after banTime without one.
+type authThrottle struct {
+	delay    time.Duration
+	maxDelay time.Duration
+	banAfter int
+	banTime  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*authFailures
+}
+
+type authFailures struct {
+	count       int
+	last        time.Time
+	bannedUntil time.Time
+}
+
+func newAuthThrottle(opts *sshdOptions) *authThrottle {
+	return &authThrottle{
+		delay:    opts.AuthDelay,
+		maxDelay: opts.AuthMaxDelay,
+		banAfter: opts.BanAfter,
+		banTime:  opts.BanTime,
+		hosts:    make(map[string]*authFailures),
+	}
+}
+
+func addrHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// expireLocked drops the records that are neither banned nor recent.
+func (t *authThrottle) expireLocked(now time.Time) {
+	for host, f := range t.hosts {
+		if now.After(f.bannedUntil) && now.Sub(f.last) > t.banTime {
+			delete(t.hosts, host)
+		}
+	}
+}
+
+// banned reports whether addr is banned at the moment.
+func (t *authThrottle) banned(addr net.Addr) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f := t.hosts[addrHost(addr)]
+	if f == nil || time.Now().After(f.bannedUntil) {
+		return time.Time{}, false
+	}
+	return f.bannedUntil, true
+}
+
+// failed records a failed login from addr and returns how long to wait
+// before answering the client.
+func (t *authThrottle) failed(addr net.Addr) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.expireLocked(now)
+	host := addrHost(addr)
+	f := t.hosts[host]
+	if f == nil {
+		f = &authFailures{}
+		t.hosts[host] = f
+	}
+	f.count++
+	f.last = now
+
+	if t.banAfter > 0 && f.count >= t.banAfter && now.After(f.bannedUntil) {
+		f.bannedUntil = now.Add(t.banTime)
+		log.Printf("Banning %s for %s after %d failed logins", host, t.banTime, f.count)
+	}
+
+	delay := t.delay
+	for i := 1; i < f.count && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+	return delay
+}
+
+// succeeded forgets the failures of addr.
+func (t *authThrottle) succeeded(addr net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	host := addrHost(addr)
+	if f := t.hosts[host]; f != nil && time.Now().After(f.bannedUntil) {
+		delete(t.hosts, host)
+	}
+}
+
+// connCallback drops connections from banned addresses before the handshake.
+func (t *authThrottle) connCallback(ctx ssh.Context, conn net.Conn) net.Conn {
+	if until, ok := t.banned(conn.RemoteAddr()); ok {
+		log.Printf("Refusing connection from %s: banned until %s", conn.RemoteAddr(), until.Format(time.RFC3339))
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// check runs the credential check login for a client, answering ever more
+// slowly after failures from its address and refusing it while banned.
+func (t *authThrottle) check(ctx ssh.Context, login func() bool) bool {
+	if _, ok := t.banned(ctx.RemoteAddr()); ok {
+		return false
+	}
+	if login() {
+		t.succeeded(ctx.RemoteAddr())
+		return true
+	}
+	time.Sleep(t.failed(ctx.RemoteAddr()))
+	return false
+}
+
+// passwordHandler wraps next so that password guesses are throttled.
+func (t *authThrottle) passwordHandler(next ssh.PasswordHandler) ssh.PasswordHandler {
+	return func(ctx ssh.Context, password string) bool {
+		return t.check(ctx, func() bool {
+			return next(ctx, password)
+		})
+	}
+}
+
+// authLogCallback logs every failed authentication attempt.
+func authLogCallback(conn gossh.ConnMetadata, method string, err error) {
+	if err == nil || method == "none" {
+		return
+	}
+	var partial *gossh.PartialSuccessError
+	if errors.As(err, &partial) {
+		log.Printf("Accepted %s for %s from %s, verification code required", method, conn.User(), conn.RemoteAddr())
+		return
+	}
+	log.Printf("Failed %s for %s from %s: %s", method, conn.User(), conn.RemoteAddr(), err)
+}
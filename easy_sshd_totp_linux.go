@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var errPermissionDenied = errors.New("permission denied")
+
+// checkTOTP verifies a code of the user's secret, allowing one time step of
+// clock skew. A code is accepted only once.
+func (u *sshdUser) checkTOTP(code string) bool {
+	key, err := decodeTOTPSecret(u.TOTPSecret)
+	if err != nil {
+		log.Printf("user %s: invalid TOTP secret: %s", u.Name, err)
+		return false
+	}
+
+	u.totp.mu.Lock()
+	defer u.totp.mu.Unlock()
+
+	now := totpStep(time.Now())
+	for step := now - 1; step <= now+1; step++ {
+		if step <= u.totp.lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			u.totp.lastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+// setConnMetadata stores the connection details in ctx the way the ssh
+// package does for the handlers it calls itself. The user is updated on
+// every attempt, as clients may change it between attempts.
+func setConnMetadata(ctx ssh.Context, conn gossh.ConnMetadata) {
+	ctx.SetValue(ssh.ContextKeyUser, conn.User())
+	if ctx.Value(ssh.ContextKeySessionID) != nil {
+		return
+	}
+	ctx.SetValue(ssh.ContextKeySessionID, hex.EncodeToString(conn.SessionID()))
+	ctx.SetValue(ssh.ContextKeyClientVersion, string(conn.ClientVersion()))
+	ctx.SetValue(ssh.ContextKeyServerVersion, string(conn.ServerVersion()))
+	ctx.SetValue(ssh.ContextKeyLocalAddr, conn.LocalAddr())
+	ctx.SetValue(ssh.ContextKeyRemoteAddr, conn.RemoteAddr())
+}
+
+// setAuthCallbacks installs the password, public key and keyboard-interactive
+// callbacks on config. Users with a TOTP secret only partially succeed with
+// a password or key and are then asked for a verification code by
+// keyboard-interactive.
+//
+// The callbacks are set here rather than through the server's handlers
+// because those cannot ask for a second factor, and share one Permissions
+// between all attempts of a connection. Each callback returns permissions
+// of its own instead, naming the user and key it accepted.
+func setAuthCallbacks(ctx ssh.Context, config *gossh.ServerConfig, throttle *authThrottle, password ssh.PasswordHandler, publicKey ssh.PublicKeyHandler) {
+	users := connCredentials(ctx).users
+	firstFactor := func(conn gossh.ConnMetadata, ok bool, perms *gossh.Permissions) (*gossh.Permissions, error) {
+		u := users[conn.User()]
+		if !ok || u == nil {
+			return nil, errPermissionDenied
+		}
+		perms.Extensions[permissionUser] = conn.User()
+		if u.TOTPSecret == "" {
+			return perms, nil
+		}
+		// perms go along so that the ssh package still checks their
+		// source-address before asking for the second factor
+		return perms, &gossh.PartialSuccessError{
+			Next: gossh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: totpCallback(ctx, throttle, u, perms),
+			},
+		}
+	}
+
+	if password != nil {
+		config.PasswordCallback = func(conn gossh.ConnMetadata, pw []byte) (*gossh.Permissions, error) {
+			setConnMetadata(ctx, conn)
+			perms := &gossh.Permissions{Extensions: map[string]string{}}
+			return firstFactor(conn, password(ctx, string(pw)), perms)
+		}
+	}
+	config.PublicKeyCallback = func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+		setConnMetadata(ctx, conn)
+		perms := &gossh.Permissions{
+			Extensions: map[string]string{permissionFingerprint: gossh.FingerprintSHA256(key)},
+		}
+		if cert, ok := key.(*gossh.Certificate); ok {
+			// the ssh package enforces source-address from the permissions
+			perms.CriticalOptions = cert.CriticalOptions
+		}
+		return firstFactor(conn, publicKey(ctx, key), perms)
+	}
+	config.KeyboardInteractiveCallback = keyboardInteractiveCallback(ctx, throttle, users)
+	// without auth handlers on the server, the ssh package lets clients
+	// log in with the none method unless this refuses it
+	config.NoClientAuthCallback = func(gossh.ConnMetadata) (*gossh.Permissions, error) {
+		return nil, errPermissionDenied
+	}
+}
+
+// totpCallback asks for the verification code of u after a successful
+// password or public key login with perms.
+func totpCallback(ctx ssh.Context, throttle *authThrottle, u *sshdUser, perms *gossh.Permissions) func(gossh.ConnMetadata, gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+	return func(conn gossh.ConnMetadata, challenge gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+		ok := throttle.check(ctx, func() bool {
+			answers, err := challenge("", "", []string{"Verification code: "}, []bool{false})
+			return err == nil && len(answers) == 1 && u.checkTOTP(answers[0])
+		})
+		if !ok {
+			return nil, errPermissionDenied
+		}
+		return perms, nil
+	}
+}
+
+// keyboardInteractiveCallback lets clients that prefer keyboard-interactive
+// log in with their password, and verification code when the user has a
+// TOTP secret, in one exchange.
+func keyboardInteractiveCallback(ctx ssh.Context, throttle *authThrottle, users map[string]*sshdUser) func(gossh.ConnMetadata, gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+	return func(conn gossh.ConnMetadata, challenge gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+		setConnMetadata(ctx, conn)
+		u := users[conn.User()]
+		if u == nil || !u.hasPassword() {
+			return nil, errPermissionDenied
+		}
+		ok := throttle.check(ctx, func() bool {
+			return keyboardInteractiveLogin(u, challenge)
+		})
+		if !ok {
+			return nil, errPermissionDenied
+		}
+		return &gossh.Permissions{Extensions: map[string]string{permissionUser: conn.User()}}, nil
+	}
+}
+
+func keyboardInteractiveLogin(u *sshdUser, challenge gossh.KeyboardInteractiveChallenge) bool {
+	questions := []string{"Password: "}
+	echos := []bool{false}
+	if u.TOTPSecret != "" {
+		questions = append(questions, "Verification code: ")
+		echos = append(echos, false)
+	}
+	answers, err := challenge("", "", questions, echos)
+	if err != nil || len(answers) != len(questions) {
+		return false
+	}
+	if !u.checkPassword(answers[0]) {
+		return false
+	}
+	return u.TOTPSecret == "" || u.checkTOTP(answers[1])
+}
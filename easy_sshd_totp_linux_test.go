@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testTOTPServer serves logins of alice, who has a TOTP secret, with
+// certificates of ca on a loopback address, and returns the address and
+// the secret.
+func testTOTPServer(t *testing.T, ca gossh.Signer) (string, []byte) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := &sshdCredentials{
+		users: map[string]*sshdUser{
+			"alice": {Name: "alice", TOTPSecret: secret, totp: &totpUsed{}},
+		},
+		certs: &userCertChecker{cas: []gossh.PublicKey{ca.PublicKey()}},
+	}
+	throttle := newAuthThrottle(&sshdOptions{})
+	srv := &ssh.Server{
+		Handler: func(s ssh.Session) {},
+		ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
+			ctx.SetValue(contextKeyCredentials, creds)
+			config := &gossh.ServerConfig{}
+			setAuthCallbacks(ctx, config, throttle, nil, publicKeyHandler(creds.users, creds.certs, nil))
+			return config
+		},
+	}
+	srv.AddHostKey(testSigner(t, 9))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String(), key
+}
+
+func TestTOTPCertificateSourceAddress(t *testing.T) {
+	ca := testSigner(t, 5)
+	tests := []struct {
+		sourceAddress string
+		ok            bool
+	}{
+		{"127.0.0.1/32", true},
+		{"10.9.9.9/32", false},
+	}
+	for _, tt := range tests {
+		addr, key := testTOTPServer(t, ca)
+		cert := &gossh.Certificate{
+			Key:             testSigner(t, 4).PublicKey(),
+			CertType:        gossh.UserCert,
+			ValidPrincipals: []string{"alice"},
+			ValidBefore:     gossh.CertTimeInfinity,
+			Permissions: gossh.Permissions{
+				CriticalOptions: map[string]string{"source-address": tt.sourceAddress},
+			},
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := gossh.NewCertSigner(cert, testSigner(t, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		asked := false
+		client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+			User: "alice",
+			Auth: []gossh.AuthMethod{
+				gossh.PublicKeys(signer),
+				gossh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+					asked = true
+					answers := make([]string, len(questions))
+					for i := range answers {
+						answers[i] = totpCode(key, totpStep(time.Now()))
+					}
+					return answers, nil
+				}),
+			},
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			client.Close()
+		}
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("source-address %s: logged in = %v (%v), want %v", tt.sourceAddress, ok, err, tt.ok)
+		}
+		if asked != tt.ok {
+			t.Errorf("source-address %s: asked for verification code = %v, want %v", tt.sourceAddress, asked, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sshdConfigFile is the -config file of easy-sshd, for example:
+//
+//	{
+//	  "users": [
+//	    {
+//	      "name": "alice",
+//	      "password_hash": "$2a$10$...",
+//	      "authorized_keys": ["ssh-ed25519 AAAA... alice@laptop"],
+//	      "command": "/bin/bash --login",
+//	      "home": "/data/alice",
+//	      "env": {"PYTHONPATH": "/data/alice/lib"},
+//	      "sftp_root": "/data/alice",
+//	      "totp_secret": "JBSWY3DPEHPK3PXP..."
+//	    }
+//	  ],
+//	  "subsystems": {
+//	    "summary": {"builtin": "file-summary"},
+//	    "dap": {"command": "dlv dap"}
+//	  }
+//	}
+type sshdConfigFile struct {
+	Users      []*sshdUser               `json:"users"`
+	Subsystems map[string]*sshdSubsystem `json:"subsystems"`
+}
+
+// sshdUser is an account that can log into easy-sshd.
+type sshdUser struct {
+	Name               string            `json:"name"`
+	PasswordHash       string            `json:"password_hash"`
+	AuthorizedKeys     []string          `json:"authorized_keys"`
+	AuthorizedKeysFile string            `json:"authorized_keys_file"`
+	Command            string            `json:"command"`
+	Home               string            `json:"home"`
+	Env                map[string]string `json:"env"`
+	SftpRoot           string            `json:"sftp_root"`
+	TOTPSecret         string            `json:"totp_secret"`
+
+	// password is the plain text password of the -user/-password shortcut
+	password string
+	keys     []*authorizedKey
+
+	totp *totpUsed
+}
+
+// totpUsed remembers the last time step a verification code was accepted
+// for. Reloading keeps it for users whose secret did not change.
+type totpUsed struct {
+	mu       sync.Mutex
+	lastStep int64
+}
+
+var contextKeyUser = &sshdContextKey{"user"}
+
+func readSSHDConfig(fileName string) (*sshdConfigFile, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var config sshdConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return &config, nil
+}
+
+// loadSSHDUsers returns the users of the -config file, or the single user
+// given by -user, -password or -password-file and -authorized-keys when
+// there is no config.
+func loadSSHDUsers(opts *sshdOptions) (map[string]*sshdUser, error) {
+	var users []*sshdUser
+	if opts.Config != "" {
+		config, err := readSSHDConfig(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		users = config.Users
+	} else {
+		password := opts.Password
+		if opts.PasswordFile != "" {
+			data, err := os.ReadFile(opts.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimRight(string(data), "\r\n")
+		}
+		users = []*sshdUser{{
+			Name:               opts.User,
+			AuthorizedKeysFile: opts.AuthorizedKeys,
+			TOTPSecret:         opts.TOTPSecret,
+			password:           password,
+		}}
+	}
+
+	resp := make(map[string]*sshdUser)
+	for _, u := range users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user without name")
+		}
+		if _, ok := resp[u.Name]; ok {
+			return nil, fmt.Errorf("duplicate user %s", u.Name)
+		}
+		if u.Command == "" {
+			u.Command = opts.Command
+		}
+		if u.TOTPSecret != "" {
+			if _, err := decodeTOTPSecret(u.TOTPSecret); err != nil {
+				return nil, fmt.Errorf("user %s: invalid TOTP secret: %w", u.Name, err)
+			}
+		}
+		u.totp = &totpUsed{}
+
+		keys, err := loadAuthorizedKeys(u.AuthorizedKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", u.Name, err)
+		}
+		u.keys = append(keys, parseAuthorizedKeys([]byte(strings.Join(u.AuthorizedKeys, "\n")))...)
+		resp[u.Name] = u
+	}
+	return resp, nil
+}
+
+func (u *sshdUser) hasPassword() bool {
+	return u.PasswordHash != "" || u.password != ""
+}
+
+func (u *sshdUser) checkPassword(password string) bool {
+	if u.PasswordHash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+	}
+	if u.password != "" {
+		return subtle.ConstantTimeCompare([]byte(u.password), []byte(password)) == 1
+	}
+	return false
+}
+
+// environ returns the configured environment in "key=value" form.
+func (u *sshdUser) environ() []string {
+	var env []string
+	for k, v := range u.Env {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// sessionUser returns the user the connection authenticated as.
+func sessionUser(ctx ssh.Context) *sshdUser {
+	u, _ := ctx.Value(contextKeyUser).(*sshdUser)
+	return u
+}
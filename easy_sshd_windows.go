@@ -4,5 +4,5 @@ func easySSHD() {
 	panic("easySSHD() is not implemented")
 }
 
-func startSSHD(host, port, user, password, command string) {
+func startSSHD(opts *sshdOptions) {
 }
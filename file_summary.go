@@ -445,13 +445,13 @@ func fileSummaryWebServer() {
 	if sftpPort != "" {
 		go func() {
 			log.Println("SFTP server is starting")
-			startSSHD(
-				"127.0.0.1",
-				sftpPort,
-				"root",
-				"root",
-				"/bin/bash --login",
-			)
+			startSSHD(&sshdOptions{
+				Host:     "127.0.0.1",
+				Port:     sftpPort,
+				User:     "root",
+				Password: "root",
+				Command:  "/bin/bash --login",
+			})
 		}()
 	}
 
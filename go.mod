@@ -1,6 +1,6 @@
 module ppobox
 
-go 1.19
+go 1.22
 
 require (
 	github.com/creack/pty v1.1.24
@@ -12,7 +12,7 @@ require (
 	github.com/spf13/cast v1.7.0
 	github.com/urfave/cli/v2 v2.27.5
 	goftp.io/server/v2 v2.0.1
-	golang.org/x/crypto v0.23.0
+	golang.org/x/crypto v0.31.0
 )
 
 require (
@@ -7,7 +7,9 @@ import (
 
 const description = `
 easy-sshd: Start an SSH server that allows you to login with a password.
+easy-sshd-totp-setup: Generate a TOTP secret for easy-sshd logins.
 gotty: Share your terminal as a web application.
+replay: Play back an easy-sshd session recording.
 `
 
 func main() {
@@ -19,8 +21,12 @@ func main() {
 	switch op {
 	case "easy-sshd":
 		easySSHD()
+	case "easy-sshd-totp-setup":
+		totpSetupMain()
 	case "gosftp-push":
 		sftpPush()
+	case "gosftp-pull":
+		sftpPull()
 	case "gotty":
 		goTTY()
 	case "goftp":
@@ -33,6 +39,8 @@ func main() {
 		fileSummaryDiffMain()
 	case "file-summary-web":
 		fileSummaryWebServer()
+	case "replay":
+		replayMain()
 	default:
 		panic("Invalid operation")
 	}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TOTP parameters of RFC 6238 as used by common authenticator apps.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random secret in base32.
+func generateTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// decodeTOTPSecret accepts base32 with or without padding, spaces and in
+// lower case, the way authenticator apps show secrets.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return totpEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// totpStep returns the time step t falls into.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode computes the code of key for a time step (RFC 4226 HOTP with
+// the step as counter).
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpURI returns the otpauth:// URI authenticator apps import secrets from.
+func totpURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// totpSetupMain generates a TOTP secret for an easy-sshd user and prints
+// it together with the URI to add it to an authenticator app.
+func totpSetupMain() {
+	newFlag := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	var user string
+	var issuer string
+	newFlag.StringVar(&user, "user", "root", "User the secret is for")
+	newFlag.StringVar(&issuer, "issuer", "easy-sshd", "Issuer shown in the authenticator app")
+	err := newFlag.Parse(os.Args[2:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hostname, err := os.Hostname(); err == nil && issuer == "easy-sshd" {
+		issuer = "easy-sshd " + hostname
+	}
+	fmt.Printf("Secret: %s\n", secret)
+	fmt.Printf("URI:    %s\n", totpURI(issuer, user, secret))
+	fmt.Println()
+	fmt.Printf("Start easy-sshd with -totp-secret %s, or add\n", secret)
+	fmt.Printf("  \"totp_secret\": %q\n", secret)
+	fmt.Printf("to the user %s in the -config file.\n", user)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, appendix B, cut to six digits.
+func TestTOTPCode(t *testing.T) {
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, totpStep(time.Unix(tt.time, 0))); got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.time, got, tt.code)
+		}
+	}
+}
+
+func TestDecodeTOTPSecret(t *testing.T) {
+	tests := []string{
+		"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"gezdgnbvgy3tqojqgezdgnbvgy3tqojq",
+		"GEZD GNBV GY3T QOJQ GEZD GNBV GY3T QOJQ",
+		"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ======",
+	}
+	for _, secret := range tests {
+		key, err := decodeTOTPSecret(secret)
+		if err != nil {
+			t.Errorf("decodeTOTPSecret(%q): %s", secret, err)
+		} else if string(key) != "12345678901234567890" {
+			t.Errorf("decodeTOTPSecret(%q) = %q", secret, key)
+		}
+	}
+	if _, err := decodeTOTPSecret("not base32!"); err == nil {
+		t.Error("decodeTOTPSecret accepted invalid base32")
+	}
+}